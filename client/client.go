@@ -0,0 +1,336 @@
+// Package client implements the client side of the relay protocol: it
+// connects to a semrelay server, registers for a user's notifications, passes
+// them to a Handler, and acknowledges them, reconnecting as needed.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/csw/semrelay"
+)
+
+const (
+	writeWait    = 10 * time.Second
+	registerWait = 15 * time.Second
+	pingWait     = 60 * time.Second
+
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = time.Minute
+)
+
+// Handler is called for each message received from the relay after
+// registration, i.e. notifications and dismissals. Notifications are
+// acknowledged when it returns nil. Returning an error drops the connection;
+// the server will redeliver any unacknowledged notifications after
+// reconnecting.
+type Handler func(ctx context.Context, msg *semrelay.Message) error
+
+// Options configures a Client.
+type Options struct {
+	// Server is the relay hostname, optionally with a port.
+	Server string
+	// URL overrides the WebSocket URL derived from Server, e.g. to use ws://
+	// for testing.
+	URL string
+	// User is the GitHub user to receive notifications for.
+	User string
+	// Password is the relay password.
+	Password string
+	// Dialer is used to connect to the relay. websocket.DefaultDialer is used
+	// if nil.
+	Dialer *websocket.Dialer
+	// MinBackoff is the initial delay before reconnecting.
+	MinBackoff time.Duration
+	// MaxBackoff caps the delay between reconnection attempts.
+	MaxBackoff time.Duration
+	// Jitter randomly shortens each delay by up to this fraction of it, so
+	// that clients disconnected together don't all reconnect at once.
+	Jitter float64
+	// OnStateChange, if set, is called with the new state when the client
+	// connects or a connection attempt fails. It must not block.
+	OnStateChange func(State)
+}
+
+// State describes the client's connection to the relay.
+type State struct {
+	// Connected is true while the client is connected and registered.
+	Connected bool
+	// Since is when the client connected, or when it lost the connection
+	// or first failed to connect.
+	Since time.Time
+	// LastError is the error from the most recent connection failure.
+	LastError error
+	// Attempts counts the failed attempts since the client was last
+	// connected.
+	Attempts int
+	// NextRetry is when the client will try to connect again, if it isn't
+	// connected.
+	NextRetry time.Time
+}
+
+// Client maintains a connection to the relay.
+type Client struct {
+	opts        Options
+	handler     Handler
+	dismissCh   chan uint64
+	reconnectCh chan struct{}
+	rand        *rand.Rand
+
+	mu    sync.Mutex
+	state State
+}
+
+func New(opts Options, handler Handler) *Client {
+	if opts.Dialer == nil {
+		opts.Dialer = websocket.DefaultDialer
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = defaultMaxBackoff
+		if opts.MaxBackoff < opts.MinBackoff {
+			opts.MaxBackoff = opts.MinBackoff
+		}
+	}
+	if opts.Jitter < 0 || opts.Jitter > 1 {
+		opts.Jitter = 0
+	}
+	return &Client{
+		opts:        opts,
+		handler:     handler,
+		dismissCh:   make(chan uint64, 8),
+		reconnectCh: make(chan struct{}, 1),
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		state:       State{Since: time.Now()},
+	}
+}
+
+// State returns the current connection state.
+func (c *Client) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// setConnected records that the client has connected and registered.
+func (c *Client) setConnected() {
+	c.updateState(func(s *State) {
+		*s = State{Connected: true, Since: time.Now(), LastError: s.LastError}
+	})
+}
+
+// setFailed records a connection failure and the time of the next attempt.
+func (c *Client) setFailed(err error, delay time.Duration) {
+	c.updateState(func(s *State) {
+		now := time.Now()
+		if s.Connected {
+			s.Connected = false
+			s.Since = now
+			s.Attempts = 0
+		}
+		if err != nil {
+			s.LastError = err
+		}
+		s.Attempts++
+		s.NextRetry = now.Add(delay)
+	})
+}
+
+func (c *Client) updateState(update func(s *State)) {
+	c.mu.Lock()
+	update(&c.state)
+	state := c.state
+	c.mu.Unlock()
+	if c.opts.OnStateChange != nil {
+		c.opts.OnStateChange(state)
+	}
+}
+
+// jitter randomly shortens the backoff delay.
+func (c *Client) jitter(d time.Duration) time.Duration {
+	if c.opts.Jitter == 0 {
+		return d
+	}
+	return d - time.Duration(c.rand.Float64()*c.opts.Jitter*float64(d))
+}
+
+func (c *Client) url() string {
+	if c.opts.URL != "" {
+		return c.opts.URL
+	}
+	return fmt.Sprintf("wss://%s/ws", c.opts.Server)
+}
+
+// Dismiss queues a dismissal of the notification with the given id, to be
+// relayed to the user's other clients. It doesn't block; if the queue is full
+// the dismissal is dropped.
+func (c *Client) Dismiss(id uint64) {
+	select {
+	case c.dismissCh <- id:
+	default:
+		log.WithField("id", id).Warn("Dismissal queue full, dropping dismissal.")
+	}
+}
+
+// Reconnect closes the current connection, if any, and connects again without
+// waiting for the backoff delay. It doesn't block.
+func (c *Client) Reconnect() {
+	select {
+	case c.reconnectCh <- struct{}{}:
+	default:
+		// already requested
+	}
+}
+
+// Run connects to the relay and handles messages until the context is
+// cancelled, reconnecting with exponential backoff when the connection fails.
+// It returns the context's error.
+func (c *Client) Run(ctx context.Context) error {
+	backoff := c.opts.MinBackoff
+	for {
+		if err := ctx.Err(); err != nil {
+			// check for cancellation
+			return err
+		}
+		registered, err := c.runConnection(ctx)
+		if ctx.Err() != nil {
+			// canceled, exit gracefully and quietly
+			return ctx.Err()
+		}
+		if err != nil {
+			logConnError(err)
+		}
+		if registered {
+			backoff = c.opts.MinBackoff
+		}
+		delay := c.jitter(backoff)
+		c.setFailed(err, delay)
+		log.Debugf("Reconnecting in %s.", delay.Round(time.Millisecond))
+		if c.sleep(ctx, delay) {
+			log.Debug("Reconnecting now.")
+			backoff = c.opts.MinBackoff
+			continue
+		}
+		backoff *= 2
+		if backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+}
+
+// runConnection handles a single connection to the relay, returning when it
+// fails. It reports whether registration succeeded, to reset the backoff.
+func (c *Client) runConnection(ctx context.Context) (bool, error) {
+	ws, _, err := c.opts.Dialer.DialContext(ctx, c.url(), nil)
+	if err != nil {
+		return false, &connectError{err}
+	}
+	// a reconnection requested while dialing is satisfied by this connection
+	select {
+	case <-c.reconnectCh:
+	default:
+	}
+	conn := newConn(ws, c.dismissCh)
+	defer conn.close()
+	// close the connection on cancellation or a reconnection request, to
+	// interrupt a blocking read
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = ws.Close()
+		case <-c.reconnectCh:
+			log.Info("Reconnecting.")
+			// skip the backoff delay
+			c.Reconnect()
+			_ = ws.Close()
+		case <-done:
+		}
+	}()
+	conn.initPings()
+	log.Infof("Connected to %s.", c.opts.Server)
+
+	if err := conn.register(c.opts.User, c.opts.Password); err != nil {
+		return false, &registrationError{err}
+	}
+	log.Debug("Registered.")
+	c.setConnected()
+	conn.start()
+
+	for {
+		if err := ws.SetReadDeadline(time.Now().Add(pingWait)); err != nil {
+			panic(err)
+		}
+		var msg semrelay.Message
+		if err := ws.ReadJSON(&msg); err != nil {
+			return true, err
+		}
+		if err := c.handle(ctx, conn, &msg); err != nil {
+			return true, fmt.Errorf("error handling message: %w", err)
+		}
+	}
+}
+
+func (c *Client) handle(ctx context.Context, conn *conn, msg *semrelay.Message) error {
+	log.WithFields(log.Fields{"type": msg.Type, "id": msg.Id}).Debug("Received message.")
+	if err := c.handler(ctx, msg); err != nil {
+		return err
+	}
+	if msg.Type == semrelay.NotificationMsg {
+		ack := semrelay.MakeAck(msg.Id)
+		log.Debugf("Sending ack for message %d.", msg.Id)
+		conn.send(&ack)
+	}
+	return nil
+}
+
+type connectError struct{ err error }
+
+func (e *connectError) Error() string { return "connection failed: " + e.err.Error() }
+func (e *connectError) Unwrap() error { return e.err }
+
+type registrationError struct{ err error }
+
+func (e *registrationError) Error() string { return "registration failed: " + e.err.Error() }
+func (e *registrationError) Unwrap() error { return e.err }
+
+func logConnError(err error) {
+	var connErr *connectError
+	var regErr *registrationError
+	if errors.As(err, &connErr) {
+		log.WithError(connErr.err).Warn("Connection failed.")
+	} else if errors.As(err, &regErr) {
+		log.WithError(regErr.err).Error("Registration failed.")
+	} else if websocket.IsUnexpectedCloseError(err) {
+		log.Warn("Connection closed.")
+	} else if isTimeout(err) {
+		log.Warn("Communication with server timed out.")
+	} else {
+		log.WithError(err).Error("Connection failed.")
+	}
+}
+
+// sleep waits for the backoff delay, reporting whether it was interrupted by
+// a reconnection request.
+func (c *Client) sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	// allow interruption by context cancellation
+	case <-ctx.Done():
+	case <-c.reconnectCh:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csw/semrelay"
+)
+
+// fakeRelay accepts connections, checks registration, sends each connection
+// the given messages, and reports what the client sends back.
+type fakeRelay struct {
+	password string
+	messages []*semrelay.Message
+	recvCh   chan semrelay.Message
+	connCh   chan struct{}
+}
+
+func newFakeRelay(t *testing.T, messages ...*semrelay.Message) (*fakeRelay, *httptest.Server) {
+	relay := &fakeRelay{
+		password: "password",
+		messages: messages,
+		recvCh:   make(chan semrelay.Message, 32),
+		connCh:   make(chan struct{}, 8),
+	}
+	srv := httptest.NewServer(relay)
+	t.Cleanup(srv.Close)
+	return relay, srv
+}
+
+func (f *fakeRelay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	f.connCh <- struct{}{}
+	var msg semrelay.Message
+	if err := conn.ReadJSON(&msg); err != nil {
+		return
+	}
+	var reg semrelay.Registration
+	if msg.Type != semrelay.RegistrationMsg ||
+		json.Unmarshal(msg.Payload, &reg) != nil || reg.Password != f.password {
+		return
+	}
+	if err := conn.WriteJSON(semrelay.MakeHello()); err != nil {
+		return
+	}
+	for _, msg := range f.messages {
+		if err := conn.WriteJSON(msg); err != nil {
+			return
+		}
+	}
+	for {
+		var msg semrelay.Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		f.recvCh <- msg
+	}
+}
+
+func (f *fakeRelay) await(t *testing.T) semrelay.Message {
+	select {
+	case msg := <-f.recvCh:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message from client")
+		return semrelay.Message{}
+	}
+}
+
+func wsURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+func runClient(t *testing.T, opts Options, handler Handler) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(opts, handler)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		assert.Equal(t, context.Canceled, <-done)
+	})
+	return c
+}
+
+func TestAck(t *testing.T) {
+	relay, srv := newFakeRelay(t, semrelay.MakeNotification(42, json.RawMessage(`{}`)))
+	handled := make(chan uint64, 1)
+	runClient(t, Options{URL: wsURL(srv), User: "bob", Password: "password"},
+		func(ctx context.Context, msg *semrelay.Message) error {
+			handled <- msg.Id
+			return nil
+		})
+	assert.Equal(t, uint64(42), <-handled)
+	ack := relay.await(t)
+	assert.Equal(t, semrelay.AckMsg, ack.Type)
+	assert.Equal(t, uint64(42), ack.Id)
+}
+
+func TestDismiss(t *testing.T) {
+	relay, srv := newFakeRelay(t)
+	c := runClient(t, Options{URL: wsURL(srv), User: "bob", Password: "password"},
+		func(ctx context.Context, msg *semrelay.Message) error { return nil })
+	c.Dismiss(7)
+	msg := relay.await(t)
+	assert.Equal(t, semrelay.DismissMsg, msg.Type)
+	assert.Equal(t, uint64(7), msg.Id)
+}
+
+func TestHandlerErrorReconnects(t *testing.T) {
+	relay, srv := newFakeRelay(t, semrelay.MakeNotification(42, json.RawMessage(`{}`)))
+	calls := make(chan struct{}, 8)
+	runClient(t, Options{
+		URL:        wsURL(srv),
+		User:       "bob",
+		Password:   "password",
+		MinBackoff: 10 * time.Millisecond,
+	}, func(ctx context.Context, msg *semrelay.Message) error {
+		calls <- struct{}{}
+		if len(calls) == 1 {
+			return assert.AnError
+		}
+		return nil
+	})
+	ack := relay.await(t)
+	assert.Equal(t, semrelay.AckMsg, ack.Type)
+	require.Len(t, relay.connCh, 2)
+}
+
+func TestRegistrationFailureRetries(t *testing.T) {
+	relay, srv := newFakeRelay(t)
+	relay.password = "other"
+	runClient(t, Options{
+		URL:        wsURL(srv),
+		User:       "bob",
+		Password:   "password",
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 20 * time.Millisecond,
+	}, func(ctx context.Context, msg *semrelay.Message) error { return nil })
+	for i := 0; i < 3; i++ {
+		select {
+		case <-relay.connCh:
+		case <-time.After(5 * time.Second):
+			t.Fatal("client did not reconnect")
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	relay, srv := newFakeRelay(t)
+	connected := make(chan struct{}, 8)
+	c := runClient(t, Options{
+		URL:        wsURL(srv),
+		User:       "bob",
+		Password:   "password",
+		MinBackoff: time.Hour,
+		OnStateChange: func(s State) {
+			if s.Connected {
+				connected <- struct{}{}
+			}
+		},
+	}, func(ctx context.Context, msg *semrelay.Message) error { return nil })
+	<-relay.connCh
+	<-connected
+	c.Reconnect()
+	select {
+	case <-relay.connCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not reconnect")
+	}
+}
+
+func TestReconnectWhileDialing(t *testing.T) {
+	relay, srv := newFakeRelay(t)
+	dialing := make(chan struct{}, 1)
+	proceed := make(chan struct{})
+	dialer := *websocket.DefaultDialer
+	dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		select {
+		case dialing <- struct{}{}:
+		default:
+		}
+		<-proceed
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	c := runClient(t, Options{
+		URL:        wsURL(srv),
+		User:       "bob",
+		Password:   "password",
+		MinBackoff: time.Hour,
+		Dialer:     &dialer,
+	}, func(ctx context.Context, msg *semrelay.Message) error { return nil })
+	<-dialing
+	c.Reconnect()
+	close(proceed)
+	<-relay.connCh
+	// the new connection isn't torn down by the earlier request
+	select {
+	case <-relay.connCh:
+		t.Fatal("client reconnected")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestStateChanges(t *testing.T) {
+	relay, srv := newFakeRelay(t)
+	relay.password = "other"
+	states := make(chan State, 32)
+	c := runClient(t, Options{
+		URL:           wsURL(srv),
+		User:          "bob",
+		Password:      "password",
+		MinBackoff:    time.Hour,
+		Jitter:        0.5,
+		OnStateChange: func(s State) { states <- s },
+	}, func(ctx context.Context, msg *semrelay.Message) error { return nil })
+	var s State
+	select {
+	case s = <-states:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no state change")
+	}
+	assert.False(t, s.Connected)
+	assert.Error(t, s.LastError)
+	assert.Equal(t, 1, s.Attempts)
+	// jitter shortens the delay by at most half
+	assert.WithinDuration(t, time.Now().Add(45*time.Minute), s.NextRetry, 15*time.Minute)
+	assert.Equal(t, s, c.State())
+
+	_, srv = newFakeRelay(t)
+	runClient(t, Options{
+		URL:           wsURL(srv),
+		User:          "bob",
+		Password:      "password",
+		OnStateChange: func(s State) { states <- s },
+	}, func(ctx context.Context, msg *semrelay.Message) error { return nil })
+	select {
+	case s = <-states:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no state change")
+	}
+	assert.True(t, s.Connected)
+	assert.True(t, s.NextRetry.IsZero())
+}
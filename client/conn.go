@@ -0,0 +1,126 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/csw/semrelay"
+)
+
+// conn is a single WebSocket connection to the relay. After registration, all
+// writes go through its send goroutine.
+type conn struct {
+	ws        *websocket.Conn
+	sendCh    chan *semrelay.Message
+	dismissCh <-chan uint64
+	sendWG    sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func newConn(ws *websocket.Conn, dismissCh <-chan uint64) *conn {
+	return &conn{
+		ws:        ws,
+		sendCh:    make(chan *semrelay.Message),
+		dismissCh: dismissCh,
+	}
+}
+
+// start starts the send goroutine. This must wait until registration is
+// complete, so that queued dismissals aren't sent first.
+func (c *conn) start() {
+	c.sendWG.Add(1)
+	go c.runSend()
+}
+
+func (c *conn) send(msg *semrelay.Message) {
+	c.sendCh <- msg
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.sendCh)
+		c.sendWG.Wait()
+		_ = c.ws.Close()
+	})
+}
+
+func (c *conn) runSend() {
+	defer c.sendWG.Done()
+	for {
+		select {
+		case msg, ok := <-c.sendCh:
+			if !ok {
+				// Connection is being closed
+				_ = c.ws.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.write(msg); err != nil {
+				log.WithError(err).Error("Error sending message.")
+				c.drain()
+				return
+			}
+		case id := <-c.dismissCh:
+			log.Debugf("Sending dismissal for message %d.", id)
+			dismiss := semrelay.MakeDismiss(id)
+			if err := c.write(&dismiss); err != nil {
+				log.WithError(err).Error("Error sending dismissal.")
+				c.drain()
+				return
+			}
+		}
+	}
+}
+
+// drain discards outgoing messages after a write error, so senders don't
+// block until the connection is closed.
+func (c *conn) drain() {
+	_ = c.ws.Close()
+	for range c.sendCh {
+	}
+}
+
+func (c *conn) write(msg *semrelay.Message) error {
+	if err := c.ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+		return err
+	}
+	return c.ws.WriteJSON(msg)
+}
+
+func (c *conn) initPings() {
+	// The server sends periodic pings. Instead of pinging the server ourselves,
+	// we wait for its pings to arrive and reset the read deadline when they do.
+	c.ws.SetPingHandler(func(string) error {
+		if err := c.ws.SetReadDeadline(time.Now().Add(pingWait)); err != nil {
+			return err
+		}
+		return c.ws.WriteControl(websocket.PongMessage, nil, time.Now().Add(writeWait))
+	})
+}
+
+func (c *conn) register(user, password string) error {
+	if err := c.write(semrelay.MakeRegistration(user, password)); err != nil {
+		return err
+	}
+	var msg semrelay.Message
+	if err := c.ws.SetReadDeadline(time.Now().Add(registerWait)); err != nil {
+		return err
+	}
+	if err := c.ws.ReadJSON(&msg); err != nil {
+		return err
+	}
+	if msg.Type != semrelay.HelloMsg {
+		return fmt.Errorf("Expected hello message, got %s", msg.Type)
+	}
+	return nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
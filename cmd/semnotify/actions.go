@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// action is a button on a notification, with the handler to run when it's
+// invoked.
+type action struct {
+	key   string
+	label string
+	run   func() error
+}
+
+// noticeActions returns the actions for a notice, with the default action,
+// which opens the pipeline, first.
+func noticeActions(nt *notice) []action {
+	actions := []action{{key: "default", label: "Open", run: opener(nt.URL)}}
+	semN := nt.Notification
+	if semN == nil {
+		return actions
+	}
+	actions = append(actions, apiActions(nt)...)
+	if url := semN.PullRequestURL(); url != "" {
+		actions = append(actions, action{key: "open-pr", label: "Open PR", run: opener(url)})
+	}
+	if url := semN.CompareURL(); url != "" {
+		actions = append(actions, action{key: "compare", label: "Compare", run: opener(url)})
+	}
+	if sha := semN.Revision.CommitSHA; sha != "" {
+		actions = append(actions, action{key: "copy-sha", label: "Copy SHA", run: func() error {
+			return copyToClipboard(sha)
+		}})
+	}
+	jobs := semN.FailedJobs()
+	for _, job := range jobs {
+		label := "Open failed job"
+		if len(jobs) > 1 {
+			label += ": " + job.Name
+		}
+		actions = append(actions, action{
+			key:   "job-" + job.Id,
+			label: label,
+			run:   opener(semN.JobURL(job.Id)),
+		})
+	}
+	return actions
+}
+
+func opener(url string) func() error {
+	return func() error {
+		log.WithField("url", url).Debug("Opening URL.")
+		return exec.Command("xdg-open", url).Run()
+	}
+}
+
+// copyToClipboard copies text with wl-copy on Wayland or xclip on X11, or
+// failing those, through Klipper's DBus interface.
+func copyToClipboard(text string) error {
+	var cmd *exec.Cmd
+	if _, err := exec.LookPath("wl-copy"); err == nil && os.Getenv("WAYLAND_DISPLAY") != "" {
+		cmd = exec.Command("wl-copy")
+	} else if _, err := exec.LookPath("xclip"); err == nil && os.Getenv("DISPLAY") != "" {
+		cmd = exec.Command("xclip", "-selection", "clipboard")
+	}
+	if cmd != nil {
+		cmd.Stdin = strings.NewReader(text)
+		return cmd.Run()
+	}
+	if dConn == nil {
+		return errors.New("no clipboard tool found")
+	}
+	return dConn.Object("org.kde.klipper", "/klipper").
+		Call("org.kde.klipper.klipper.setClipboardContents", 0, text).Err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csw/semrelay"
+	internal "github.com/csw/semrelay/internal"
+)
+
+func TestNoticeActions(t *testing.T) {
+	api = newSemaphoreAPI("https://semaphore.example.com", "secret")
+	defer func() { api = nil }()
+
+	withPR := func(semN *semrelay.Notification) {
+		semN.Revision.PullRequest = &semrelay.PullRequest{Number: "12"}
+	}
+	twoFailedJobs := func(semN *semrelay.Notification) {
+		semN.Blocks[0].Jobs = append(semN.Blocks[0].Jobs, &semrelay.Job{
+			Id: "j2", Name: "lint", Result: semrelay.ResultFailed,
+		})
+	}
+	failedJob := "job-2b1c3afa-efef-44d1-9583-280ccca88840"
+
+	for _, tc := range []struct {
+		name   string
+		raw    []byte
+		test   bool
+		modify func(*semrelay.Notification)
+		keys   []string
+		labels []string
+	}{
+		{
+			name: "passed",
+			raw:  internal.ExampleSuccess,
+			keys: []string{"default", "compare", "copy-sha"},
+		},
+		{
+			name:   "failed",
+			raw:    internal.ExampleFailure,
+			keys:   []string{"default", "rerun", "compare", "copy-sha", failedJob},
+			labels: []string{"Open", "Rerun", "Compare", "Copy SHA", "Open failed job"},
+		},
+		{
+			name: "test",
+			raw:  internal.ExampleFailure,
+			test: true,
+			keys: []string{"default", "compare", "copy-sha", failedJob},
+		},
+		{
+			name:   "pull request",
+			raw:    internal.ExampleSuccess,
+			modify: withPR,
+			keys:   []string{"default", "open-pr", "compare", "copy-sha"},
+		},
+		{
+			name:   "several failed jobs",
+			raw:    internal.ExampleFailure,
+			modify: twoFailedJobs,
+			keys:   []string{"default", "rerun", "compare", "copy-sha", failedJob, "job-j2"},
+			labels: []string{"Open", "Rerun", "Compare", "Copy SHA", "Open failed job: " +
+				parseExample(t, internal.ExampleFailure).FailedJobs()[0].Name, "Open failed job: lint"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			semN := parseExample(t, tc.raw)
+			if tc.modify != nil {
+				tc.modify(semN)
+			}
+			nt, err := newNotice(7, semN, tc.test)
+			require.NoError(t, err)
+			var keys, labels []string
+			for _, a := range noticeActions(nt) {
+				keys = append(keys, a.key)
+				labels = append(labels, a.label)
+			}
+			assert.Equal(t, tc.keys, keys)
+			if tc.labels != nil {
+				assert.Equal(t, tc.labels, labels)
+			}
+		})
+	}
+
+	// notices without a notification, like the quiet hours summary
+	actions := noticeActions(&notice{URL: "https://example.com"})
+	require.Len(t, actions, 1)
+	assert.Equal(t, "default", actions[0].key)
+}
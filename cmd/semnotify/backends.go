@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stdoutNotifier writes notifications to standard output as JSON lines, for
+// headless use or for other programs to consume.
+type stdoutNotifier struct {
+	enc *json.Encoder
+}
+
+type stdoutDismissal struct {
+	Type string `json:"type"`
+	Id   uint64 `json:"id,string"`
+}
+
+func newStdoutNotifier() *stdoutNotifier {
+	return &stdoutNotifier{enc: json.NewEncoder(os.Stdout)}
+}
+
+func (s *stdoutNotifier) Notify(nt *notice) error {
+	return s.enc.Encode(struct {
+		Type string `json:"type"`
+		*notice
+	}{"notification", nt})
+}
+
+func (s *stdoutNotifier) Dismiss(msgId uint64) {
+	if err := s.enc.Encode(stdoutDismissal{Type: "dismiss", Id: msgId}); err != nil {
+		log.WithError(err).Error("Error writing dismissal.")
+	}
+}
+
+func (s *stdoutNotifier) Close() error {
+	return nil
+}
+
+// notifySendNotifier shows notifications by running notify-send, for systems
+// where semnotify can't use DBus directly. Clicking and closing notifications
+// isn't supported.
+type notifySendNotifier struct {
+	path string
+}
+
+func newNotifySendNotifier() (*notifySendNotifier, error) {
+	path, err := exec.LookPath("notify-send")
+	if err != nil {
+		return nil, err
+	}
+	return &notifySendNotifier{path: path}, nil
+}
+
+func (n *notifySendNotifier) Notify(nt *notice) error {
+	urgency := "normal"
+	if nt.Failed {
+		urgency = "critical"
+	}
+	args := []string{
+		"--app-name=Semaphore",
+		"--urgency=" + urgency,
+		"--hint=string:x-dunst-stack-tag:" + nt.Tag,
+	}
+	if ttl > 0 {
+		args = append(args, fmt.Sprintf("--expire-time=%d", ttl.Milliseconds()))
+	}
+	args = append(args, "--", nt.Summary, nt.Body)
+	if out, err := exec.Command(n.path, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("notify-send failed: %w: %s", err, out)
+	}
+	return nil
+}
+
+func (n *notifySendNotifier) Dismiss(msgId uint64) {
+	log.WithField("id", msgId).Debug("Can't close notifications shown with notify-send.")
+}
+
+func (n *notifySendNotifier) Close() error {
+	return nil
+}
+
+// fileNotifier writes each notification to a JSON file in a directory, named
+// for its relay message ID, and removes it if it's dismissed on another
+// device.
+type fileNotifier struct {
+	dir string
+}
+
+func newFileNotifier(dir string) (*fileNotifier, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &fileNotifier{dir: dir}, nil
+}
+
+func (f *fileNotifier) path(msgId uint64) string {
+	return filepath.Join(f.dir, strconv.FormatUint(msgId, 10)+".json")
+}
+
+func (f *fileNotifier) Notify(nt *notice) error {
+	enc, err := json.MarshalIndent(nt, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := f.path(nt.MsgId)
+	if nt.MsgId == 0 {
+		// examples have no message ID
+		name = filepath.Join(f.dir, fmt.Sprintf("example-%d.json", time.Now().UnixNano()))
+	}
+	return writeFileAtomic(name, append(enc, '\n'))
+}
+
+// writeFileAtomic writes to a temporary file and renames it, so that programs
+// watching the file never see a partial one.
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (f *fileNotifier) Dismiss(msgId uint64) {
+	if err := os.Remove(f.path(msgId)); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Error("Error removing dismissed notification.")
+	}
+}
+
+func (f *fileNotifier) Close() error {
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	internal "github.com/csw/semrelay/internal"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "out.json")
+	require.NoError(t, writeFileAtomic(name, []byte("first")))
+	require.NoError(t, writeFileAtomic(name, []byte("second")))
+	data, err := os.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "no temporary files left behind")
+
+	assert.Error(t, writeFileAtomic(filepath.Join(dir, "missing", "out.json"), nil))
+}
+
+func TestFileNotifier(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "drop")
+	f, err := newFileNotifier(dir)
+	require.NoError(t, err)
+	nt, err := newNotice(42, parseExample(t, internal.ExampleFailure), false)
+	require.NoError(t, err)
+	require.NoError(t, f.Notify(nt))
+
+	data, err := os.ReadFile(filepath.Join(dir, "42.json"))
+	require.NoError(t, err)
+	var written map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &written))
+	assert.Equal(t, "42", written["id"])
+	assert.Equal(t, nt.Summary, written["summary"])
+	assert.Equal(t, nt.URL, written["url"])
+	assert.Equal(t, true, written["failed"])
+	assert.Equal(t, nt.Tag, written["tag"])
+	assert.NotContains(t, written, "test")
+	assert.Contains(t, written, "notification")
+
+	// examples have no message ID
+	example, err := newNotice(0, parseExample(t, internal.ExampleSuccess), true)
+	require.NoError(t, err)
+	require.NoError(t, f.Notify(example))
+	matches, err := filepath.Glob(filepath.Join(dir, "example-*.json"))
+	require.NoError(t, err)
+	assert.Len(t, matches, 1)
+
+	f.Dismiss(42)
+	assert.NoFileExists(t, filepath.Join(dir, "42.json"))
+	// already gone
+	f.Dismiss(42)
+}
@@ -3,14 +3,17 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
-	"sync"
-	"sync/atomic"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/adrg/xdg"
@@ -21,6 +24,7 @@ import (
 	"golang.org/x/sys/unix"
 
 	"github.com/csw/semrelay"
+	"github.com/csw/semrelay/client"
 	internal "github.com/csw/semrelay/internal"
 )
 
@@ -29,199 +33,142 @@ var (
 	password   string
 	server     string
 	insecure   bool
+	clientCert string
+	clientKey  string
+	caFile     string
 	promotions bool
 	ttl        time.Duration
+	// notifierName selects the Notifier backend.
+	notifierName string
+	dropDir      string
 )
 
-const (
-	writeWait    = 10 * time.Second
-	registerWait = 15 * time.Second
-	pingWait     = 60 * time.Second
-)
+var relayClient *client.Client
 
-var (
-	curClient atomic.Value
-	clientCtx context.Context
-)
-
-func run() error {
-	if err := initDBus(); err != nil {
+func run(ctx context.Context) error {
+	tlsConfig, err := clientTLSConfig()
+	if err != nil {
+		return err
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	monitor := newConnectionMonitor(viper.GetDuration("unreachable_after"))
+	relayClient = client.New(client.Options{
+		Server:        server,
+		User:          user,
+		Password:      password,
+		Dialer:        &dialer,
+		MinBackoff:    viper.GetDuration("min_backoff"),
+		MaxBackoff:    viper.GetDuration("max_backoff"),
+		Jitter:        0.5,
+		OnStateChange: monitor.update,
+	}, handleMessage)
+	if backend, err = newNotifier(notifierName); err != nil {
 		return err
 	}
 	defer func() {
-		if err := cleanupDBus(); err != nil {
+		monitor.stop()
+		if err := backend.Close(); err != nil {
 			log.WithError(err).Error("Cleanup failed.")
 		}
 	}()
-	for {
-		if err := clientCtx.Err(); err != nil {
-			// check for cancellation
-			return err
-		}
-		if err := runConnection(); err != nil {
-			return err
-		}
-		sleep(5 * time.Second)
-	}
-}
-
-func runConnection() error {
-	var err error
-	url := fmt.Sprintf("wss://%s/ws", server)
-	conn, _, err := websocket.DefaultDialer.DialContext(clientCtx, url, nil)
-	if err != nil {
-		log.WithError(err).Debug("Connection failed.")
-		return nil
-	}
-	client := newClient(clientCtx, conn)
-	defer client.close()
-	curClient.Store(client)
-	if err := clientCtx.Err(); err != nil {
-		return err
+	if seen, err = loadSeen(viper.GetString("seen_file")); err != nil {
+		return fmt.Errorf("loading shown notifications: %w", err)
 	}
-	if err := client.initPings(); err != nil {
-		log.WithError(err).Error("Failed to set up ping handling.")
-	}
-	log.Infof("Connected to %s.", server)
-
-	if err := register(client); err != nil {
-		log.WithError(err).Error("Registration failed.")
-		return nil
+	if history != nil {
+		if err := history.open(); err != nil {
+			return fmt.Errorf("opening history: %w", err)
+		}
 	}
-	log.Debug("Registered.")
-
-	for {
-		if err := conn.SetReadDeadline(time.Now().Add(pingWait)); err != nil {
-			panic(err)
+	if quiet != nil {
+		if err := quiet.loadHeld(); err != nil {
+			return fmt.Errorf("loading held notifications: %w", err)
 		}
-		_, raw, err := conn.ReadMessage()
-		if err != nil {
-			if clientCtx.Err() != nil {
-				// canceled, exit gracefully and quietly
-				return nil
-			}
-			var netErr net.Error
-			if websocket.IsUnexpectedCloseError(err) {
-				log.Warn("Connection closed.")
-				return nil
-			} else if errors.As(err, &netErr) && netErr.Timeout() {
-				log.Warn("Communication with server timed out.")
-				return nil
-			}
-			log.WithError(err).Error("ReadMessage failed.")
-			return nil
+		go quiet.run(ctx)
+	}
+	if viper.GetBool("tray") {
+		if dConn == nil {
+			return errors.New("the tray icon requires the dbus notifier")
 		}
-		if err := handleMessage(client, raw); err != nil {
-			log.WithError(err).Error("Error handling message.")
-			return nil
+		if err := startTray(viper.GetInt("tray_builds")); err != nil {
+			log.WithError(err).Warn("Tray icon unavailable.")
 		}
 	}
-}
-
-func sleep(d time.Duration) {
-	t := time.NewTimer(d)
-	// don't bother stopping the timer, if the context is cancelled we're about
-	// to exit
-	select {
-	case <-t.C:
-		return
-	// allow interruption by context cancellation
-	case <-clientCtx.Done():
-		return
-	}
-}
-
-type Client struct {
-	conn   *websocket.Conn
-	sendCh chan *semrelay.Message
-	sendWG sync.WaitGroup
-}
-
-func newClient(parentCtx context.Context, conn *websocket.Conn) *Client {
-	client := &Client{
-		conn:   conn,
-		sendCh: make(chan *semrelay.Message),
-	}
-	client.sendWG.Add(1)
-	go client.runSend()
-	return client
-}
-
-func (c *Client) close() error {
-	if c.sendCh != nil {
-		close(c.sendCh)
-		c.sendCh = nil
+	if viper.GetBool("network_monitor") {
+		if err := watchNetwork(ctx); err != nil {
+			log.WithError(err).Info("Not watching NetworkManager for network changes.")
+		}
 	}
-	c.sendWG.Wait()
-	return c.conn.Close()
+	return relayClient.Run(ctx)
 }
 
-func (c *Client) runSend() {
-	defer c.sendWG.Done()
-	for msg := range c.sendCh {
-		if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-			panic(err)
+// clientTLSConfig builds the TLS configuration for connecting to the relay,
+// with the client certificate and CA if configured.
+func clientTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
 		}
-		if err := c.conn.WriteJSON(msg); err != nil {
-			log.WithError(err).Error("Error sending message.")
-			return
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
 		}
 	}
-	// Connection is being closed
-	_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-}
-
-func (c *Client) initPings() error {
-	// The server sends periodic pings. Instead of pinging the server ourselves,
-	// we wait for its pings to arrive and reset the read deadline when they do.
-	c.conn.SetPingHandler(func(string) error {
-		if err := c.conn.SetReadDeadline(time.Now().Add(pingWait)); err != nil {
-			return err
+	if clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
 		}
-		return c.conn.WriteControl(websocket.PongMessage, nil, time.Now().Add(writeWait))
-	})
-	return nil
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
 }
 
-func handleMessage(client *Client, raw []byte) error {
-	log.Debugf("Received %d bytes: %s", len(raw), raw)
-	var msg semrelay.Message
-	if err := json.Unmarshal(raw, &msg); err != nil {
-		return fmt.Errorf("parsing message failed: %w", err)
-	}
+func handleMessage(ctx context.Context, msg *semrelay.Message) error {
 	switch msg.Type {
 	case semrelay.NotificationMsg:
 		var semN semrelay.Notification
 		if err := json.Unmarshal(msg.Payload, &semN); err != nil {
 			return err
 		}
-		if err := notifyUser(&semN); err != nil {
+		if !msg.Test && seen.duplicate(msg.Id, &semN) {
+			// redelivered after a lost ack, or sent twice; just ack it
+			log.WithField("id", msg.Id).Info("Ignoring duplicate notification.")
+			return nil
+		}
+		if history != nil && !msg.Test {
+			history.add(msg.Id, msg.Payload)
+		}
+		if !wanted(&semN, msg.Test) {
+			if !msg.Test {
+				seen.record(msg.Id, &semN)
+			}
+			return nil
+		}
+		shown, err := notifyUser(msg.Id, &semN, msg.Test)
+		if err != nil {
 			return err
 		}
-		ack := semrelay.MakeAck(msg.Id)
-		log.Debugf("Sending ack for message %d.", msg.Id)
-		client.sendCh <- &ack
+		if !msg.Test {
+			seen.record(msg.Id, &semN)
+		}
+		// only once it's been shown, so that hooks don't run again if it's
+		// redelivered after an error, or for notifications held for quiet
+		// hours or while paused
+		if shown {
+			runHooks(msg.Id, msg.Payload, &semN, msg.Test)
+		}
+	case semrelay.DismissMsg:
+		log.Debugf("Message %d dismissed on another device.", msg.Id)
+		backend.Dismiss(msg.Id)
 	default:
 		return fmt.Errorf("Unhandled message type: %s", msg.Type)
 	}
 	return nil
 }
 
-func register(client *Client) error {
-	client.sendCh <- semrelay.MakeRegistration(user, password)
-	var msg semrelay.Message
-	if err := client.conn.SetReadDeadline(time.Now().Add(registerWait)); err != nil {
-		return err
-	}
-	if err := client.conn.ReadJSON(&msg); err != nil {
-		return err
-	}
-	if msg.Type != semrelay.HelloMsg {
-		return fmt.Errorf("Expected hello message, got %s", msg.Type)
-	}
-	return nil
-}
-
 func sendExample(name string) error {
 	var msg []byte
 	switch name {
@@ -232,44 +179,102 @@ func sendExample(name string) error {
 	default:
 		return fmt.Errorf("unhandled argument %s", name)
 	}
-	if err := initDBus(); err != nil {
-		return fmt.Errorf("DBus connection error: %s", err)
-	}
 	var semN semrelay.Notification
 	if err := json.Unmarshal(msg, &semN); err != nil {
 		panic(err)
 	}
-	err := notifyUser(&semN)
-	if err == nil {
-		time.Sleep(5 * time.Second)
-	}
-	if cerr := cleanupDBus(); cerr != nil {
-		return cerr
+	nt, err := newNotice(0, &semN, true)
+	if err != nil {
+		return err
 	}
-	return err
+	return showOnce(nt)
 }
 
-// closer closes the current connection asynchronously when a signal is
-// received, to interrupt a blocking read.
-func closer() {
-	<-clientCtx.Done()
-	client := curClient.Load()
-	if client == nil {
-		return
-	}
-	_ = client.(*Client).close()
+// sendRemoteTest asks the relay server to send a test notification, which
+// goes through the server to all of the user's clients. It requires the
+// server's admin token.
+func sendRemoteTest(kind string) error {
+	adminToken := viper.GetString("admin_token")
+	if adminToken == "" {
+		return errors.New("must specify admin_token in configuration")
+	}
+	tlsConfig, err := clientTLSConfig()
+	if err != nil {
+		return err
+	}
+	query := url.Values{"user": {user}, "kind": {kind}}
+	req, err := http.NewRequest(http.MethodPost,
+		fmt.Sprintf("https://%s/admin/test?%s", server, query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	httpClient := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	var result struct {
+		Clients   int  `json:"clients"`
+		Queued    bool `json:"queued"`
+		Forwarded bool `json:"forwarded"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	switch {
+	case result.Forwarded:
+		log.Infof("Passed test notification for %s to other relay instances, since none of your clients are connected to this one.", user)
+	case result.Queued:
+		log.Infof("Queued test notification for %s; none of your clients are connected.", user)
+	default:
+		log.Infof("Sent test notification to %d of %s's clients.", result.Clients, user)
+	}
+	return nil
 }
 
 func parseConfig() error {
 	viper.SetDefault("ttl", 0) // do not expire
-	cfg, err := xdg.SearchConfigFile("semnotify/config")
-	if err != nil {
-		// config file not found
-		return nil
+	viper.SetDefault("drop_dir", filepath.Join(xdg.RuntimeDir, "semnotify"))
+	viper.SetDefault("tray_builds", 10)
+	viper.SetDefault("history", true)
+	viper.SetDefault("history_dir", filepath.Join(xdg.DataHome, "semnotify"))
+	viper.SetDefault("history_max", 1000)
+	viper.SetDefault("history_max_age", 30*24*time.Hour)
+	viper.SetDefault("status_file", filepath.Join(xdg.StateHome, "semnotify", "status.json"))
+	viper.SetDefault("seen_file", filepath.Join(xdg.StateHome, "semnotify", "seen.json"))
+	viper.SetDefault("held_file", filepath.Join(xdg.StateHome, "semnotify", "held.json"))
+	viper.SetDefault("min_backoff", 5*time.Second)
+	viper.SetDefault("max_backoff", 5*time.Minute)
+	viper.SetDefault("unreachable_after", 10*time.Minute)
+	viper.SetDefault("network_monitor", true)
+	if cfg := viper.GetString("config"); cfg != "" {
+		viper.SetConfigFile(cfg)
+		return viper.ReadInConfig()
+	}
+	// Lists such as hooks need a structured format; the original env-format
+	// file is still read if there's no YAML or TOML file.
+	for _, name := range []string{"config.yaml", "config.toml", "config"} {
+		cfg, err := xdg.SearchConfigFile(filepath.Join("semnotify", name))
+		if err != nil {
+			// config file not found
+			continue
+		}
+		if name == "config" {
+			viper.SetConfigType("env")
+		}
+		viper.SetConfigFile(cfg)
+		return viper.ReadInConfig()
 	}
-	viper.SetConfigType("env")
-	viper.SetConfigFile(cfg)
-	return viper.ReadInConfig()
+	return nil
 }
 
 func processConfig() error {
@@ -277,17 +282,37 @@ func processConfig() error {
 	password = viper.GetString("password")
 	server = viper.GetString("server")
 	insecure = viper.GetBool("insecure")
+	clientCert = viper.GetString("client_cert")
+	clientKey = viper.GetString("client_key")
+	caFile = viper.GetString("ca")
 	promotions = viper.GetBool("promotions")
 	ttl = viper.GetDuration("ttl")
+	notifierName = viper.GetString("notifier")
+	dropDir = viper.GetString("drop_dir")
+	statusFile = viper.GetString("status_file")
+	if viper.GetBool("history") {
+		history = newHistoryStore(viper.GetString("history_dir"),
+			viper.GetInt("history_max"), viper.GetDuration("history_max_age"))
+	}
+	if token := viper.GetString("api_token"); token != "" {
+		api = newSemaphoreAPI(viper.GetString("api_url"), token)
+	}
 
-	if user == "" {
-		return errors.New("must specify user in configuration")
+	if spec := viper.GetString("quiet_hours"); spec != "" {
+		var err error
+		if quiet, err = parseQuietHours(spec); err != nil {
+			return err
+		}
+		quiet.path = viper.GetString("held_file")
 	}
-	if password == "" {
-		return errors.New("must specify password in configuration")
+	if err := loadFilters(); err != nil {
+		return err
 	}
-	if server == "" {
-		return errors.New("must specify server in configuration")
+	if err := loadHooks(); err != nil {
+		return err
+	}
+	if err := loadTemplates(); err != nil {
+		return err
 	}
 
 	if viper.GetBool("verbose") {
@@ -297,6 +322,23 @@ func processConfig() error {
 	return nil
 }
 
+// checkConnectionConfig checks the settings needed to connect to the relay.
+func checkConnectionConfig() error {
+	if user == "" {
+		return errors.New("must specify user in configuration")
+	}
+	if password == "" && clientCert == "" {
+		return errors.New("must specify password or client_cert in configuration")
+	}
+	if clientCert != "" && clientKey == "" {
+		return errors.New("must specify client_key with client_cert")
+	}
+	if server == "" {
+		return errors.New("must specify server in configuration")
+	}
+	return nil
+}
+
 func main() {
 	log.SetFormatter(&log.TextFormatter{
 		FullTimestamp:          true,
@@ -304,40 +346,93 @@ func main() {
 		DisableLevelTruncation: true,
 	})
 
+	pflag.StringP("config", "c", "", "Configuration file")
 	pflag.StringP("user", "u", "", "GitHub user to receive notifications for")
 	pflag.StringP("password", "p", "", "semrelay password")
 	pflag.StringP("server", "s", "", "semrelay hostname")
 	pflag.BoolP("verbose", "v", false, "Verbose mode")
 	pflag.Duration("ttl", 0, "Notification time-to-live")
 	pflag.Bool("insecure", false, "Disable TLS certificate verification")
+	pflag.String("client-cert", "", "Client certificate file, for servers requiring one")
+	pflag.String("client-key", "", "Client certificate key file")
+	pflag.String("ca", "", "CA certificate file to verify the server with")
 	pflag.Bool("promotions", true, "Show promotion results")
+	pflag.String("notifier", "dbus", "How to show notifications: dbus, stdout, notify-send, or file")
+	pflag.String("drop-dir", "", "Directory for the file notifier")
+	pflag.String("quiet-hours", "", "Daily window to hold notifications in, e.g. 22:00-07:00")
+	pflag.String("api-url", "", "Semaphore API base URL, instead of https://ORG.semaphoreci.com")
+	pflag.Bool("remote", false, "For test, send the notification through the server")
+	pflag.String("kind", "success", "For test, the kind of notification: success or failure")
+	pflag.String("admin-token", "", "Server admin token, for test --remote")
+	pflag.Bool("tray", false, "Show a tray icon with recent builds")
+	pflag.String("status-file", "", "File to keep the latest build results in, for status")
+	pflag.String("format", "text", "For status, the output format: text, waybar, or i3blocks")
+	pflag.Bool("follow", false, "For status, write the status again whenever it changes")
+	pflag.Bool("open", false, "For status, open the latest failed or else latest workflow")
+	pflag.String("project", "", "For status and history, only include projects matching this pattern")
+	pflag.String("branch", "", "For status and history, only include branches matching this pattern")
+	pflag.Bool("failed", false, "For history, only include failed builds")
+	pflag.String("since", "", "For history, only include builds since a time, e.g. 24h or 2006-01-02")
 	pflag.Parse()
 	if err := viper.BindPFlags(pflag.CommandLine); err != nil {
 		panic(err)
 	}
+	// the configuration file can't use hyphens in keys
+	for _, name := range []string{"client-cert", "client-key", "admin-token", "drop-dir", "quiet-hours", "api-url", "status-file"} {
+		if err := viper.BindPFlag(strings.ReplaceAll(name, "-", "_"), pflag.Lookup(name)); err != nil {
+			panic(err)
+		}
+	}
 	if err := parseConfig(); err != nil {
 		log.WithError(err).Fatal("Error parsing configuration.")
 	}
+	args := pflag.Args()
+	if len(args) > 0 && args[0] == "status" {
+		// doesn't need the connection settings
+		if err := runStatus(); err != nil {
+			log.WithError(err).Fatal("Showing status failed.")
+		}
+		os.Exit(0)
+	}
+
 	if err := processConfig(); err != nil {
 		log.WithError(err).Fatal("Configuration error.")
 	}
 
-	args := pflag.Args()
-	if len(args) > 0 {
-		if err := sendExample(args[0]); err != nil {
-			log.WithError(err).Fatal("Sending example failed.")
+	if len(args) > 0 && args[0] == "history" {
+		// works offline
+		if err := runHistory(args[1:]); err != nil {
+			log.WithError(err).Fatal("Showing history failed.")
 		}
 		os.Exit(0)
 	}
 
-	clientCtx, _ = signal.NotifyContext(context.Background(),
-		os.Interrupt, os.Kill, unix.SIGTERM, unix.SIGHUP)
-	go closer()
+	if len(args) > 0 {
+		var err error
+		switch {
+		case args[0] == "test" && viper.GetBool("remote"):
+			if err = checkConnectionConfig(); err != nil {
+				break
+			}
+			err = sendRemoteTest(viper.GetString("kind"))
+		case args[0] == "test":
+			err = sendExample(viper.GetString("kind"))
+		default:
+			err = sendExample(args[0])
+		}
+		if err != nil {
+			log.WithError(err).Fatal("Sending test notification failed.")
+		}
+		os.Exit(0)
+	}
 
-	if insecure {
-		websocket.DefaultDialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	if err := checkConnectionConfig(); err != nil {
+		log.WithError(err).Fatal("Configuration error.")
 	}
-	if err := run(); err != nil {
+
+	ctx, _ := signal.NotifyContext(context.Background(),
+		os.Interrupt, os.Kill, unix.SIGTERM, unix.SIGHUP)
+	if err := run(ctx); err != nil {
 		if err != context.Canceled {
 			log.WithError(err).Fatal("Exiting with error.")
 		}
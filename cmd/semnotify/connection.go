@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/csw/semrelay/client"
+)
+
+const (
+	connConnected    = "connected"
+	connDisconnected = "disconnected"
+	connStopped      = "stopped"
+)
+
+// connectionState is the state of the connection to the relay, as saved in
+// the status file.
+type connectionState struct {
+	// State is connected, disconnected, or stopped when semnotify exits.
+	State     string     `json:"state"`
+	Server    string     `json:"server"`
+	Since     time.Time  `json:"since"`
+	LastError string     `json:"last_error,omitempty"`
+	Attempts  int        `json:"attempts,omitempty"`
+	NextRetry *time.Time `json:"next_retry,omitempty"`
+}
+
+func newConnectionState(s client.State) *connectionState {
+	cs := &connectionState{
+		State:  connDisconnected,
+		Server: server,
+		Since:  s.Since,
+	}
+	if s.Connected {
+		cs.State = connConnected
+		return cs
+	}
+	if s.LastError != nil {
+		cs.LastError = s.LastError.Error()
+	}
+	cs.Attempts = s.Attempts
+	if !s.NextRetry.IsZero() {
+		cs.NextRetry = &s.NextRetry
+	}
+	return cs
+}
+
+// describe explains the state in a sentence.
+func (cs *connectionState) describe() string {
+	since := cs.Since.Local().Format(time.Stamp)
+	switch cs.State {
+	case connConnected:
+		return fmt.Sprintf("Connected to %s since %s", cs.Server, since)
+	case connStopped:
+		return fmt.Sprintf("semnotify stopped at %s", since)
+	}
+	text := fmt.Sprintf("Disconnected from %s since %s", cs.Server, since)
+	if cs.LastError != "" {
+		text += fmt.Sprintf(" after %d failed attempts: %s", cs.Attempts, cs.LastError)
+	}
+	if cs.NextRetry != nil {
+		text += fmt.Sprintf("; retrying at %s", cs.NextRetry.Local().Format(time.Stamp))
+	}
+	return text
+}
+
+// connectionMonitor follows the state of the relay connection, saving it in
+// the status file and telling the user when the relay has been unreachable
+// for too long. It does this in its own goroutine, so that slow disks or
+// notification daemons don't hold up the client.
+type connectionMonitor struct {
+	// unreachableAfter is how long to wait before telling the user, or zero
+	// to never tell them.
+	unreachableAfter time.Duration
+
+	// pending is the latest state not yet handled; wake signals that it's
+	// set.
+	mu      sync.Mutex
+	pending *client.State
+	wake    chan struct{}
+
+	quit chan struct{}
+	done chan struct{}
+
+	// The rest is only used by run.
+	connected bool
+	lastError error
+	timer     *time.Timer
+	notified  bool
+}
+
+func newConnectionMonitor(unreachableAfter time.Duration) *connectionMonitor {
+	m := &connectionMonitor{
+		unreachableAfter: unreachableAfter,
+		wake:             make(chan struct{}, 1),
+		quit:             make(chan struct{}),
+		done:             make(chan struct{}),
+	}
+	m.startTimer()
+	go m.run()
+	return m
+}
+
+// update is called by the client on each state change. It doesn't block; if
+// states arrive faster than they're handled, only the latest is handled.
+func (m *connectionMonitor) update(s client.State) {
+	m.mu.Lock()
+	m.pending = &s
+	m.mu.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *connectionMonitor) run() {
+	defer close(m.done)
+	for {
+		var expired <-chan time.Time
+		if m.timer != nil {
+			expired = m.timer.C
+		}
+		select {
+		case <-m.quit:
+			m.stopTimer()
+			return
+		case <-m.wake:
+			m.mu.Lock()
+			s := m.pending
+			m.pending = nil
+			m.mu.Unlock()
+			if s != nil {
+				m.handle(*s)
+			}
+		case <-expired:
+			m.timer = nil
+			m.unreachable()
+		}
+	}
+}
+
+func (m *connectionMonitor) handle(s client.State) {
+	recordConnection(newConnectionState(s))
+	if !s.Connected {
+		m.lastError = s.LastError
+	}
+	if s.Connected == m.connected {
+		return
+	}
+	m.connected = s.Connected
+	if !s.Connected {
+		m.startTimer()
+		return
+	}
+	m.stopTimer()
+	if m.notified {
+		m.notified = false
+		showConnectionNotice("Reconnected to "+server, "", false)
+	}
+}
+
+// startTimer starts waiting to tell the user that the relay is unreachable.
+func (m *connectionMonitor) startTimer() {
+	if m.unreachableAfter <= 0 || m.timer != nil {
+		return
+	}
+	m.timer = time.NewTimer(m.unreachableAfter)
+}
+
+func (m *connectionMonitor) stopTimer() {
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+}
+
+func (m *connectionMonitor) unreachable() {
+	m.notified = true
+	body := fmt.Sprintf("No connection for %s.", m.unreachableAfter)
+	if m.lastError != nil {
+		body += "\n" + m.lastError.Error()
+	}
+	showConnectionNotice("Can't reach "+server, body, true)
+}
+
+// stop records that semnotify is no longer connected, on exit.
+func (m *connectionMonitor) stop() {
+	close(m.quit)
+	<-m.done
+	recordConnection(&connectionState{State: connStopped, Server: server, Since: time.Now()})
+}
+
+func recordConnection(cs *connectionState) {
+	updateStatus(func(state *statusState) {
+		state.Connection = cs
+	})
+}
+
+// connectionTag identifies connection notices, so that they replace each
+// other.
+const connectionTag = "semnotify/connection"
+
+func showConnectionNotice(summary, body string, failed bool) {
+	log.WithField("summary", summary).Info("Showing connection notification")
+	err := backend.Notify(&notice{
+		Summary: summary,
+		Body:    body,
+		Failed:  failed,
+		Tag:     connectionTag,
+	})
+	if err != nil {
+		log.WithError(err).Error("Error showing connection notification.")
+	}
+}
+
+const (
+	nmName        = "org.freedesktop.NetworkManager"
+	nmPath        = "/org/freedesktop/NetworkManager"
+	nmStateGlobal = 70 // NM_STATE_CONNECTED_GLOBAL
+)
+
+// watchNetwork reconnects to the relay immediately when NetworkManager
+// reports that the network is back, rather than waiting out the backoff
+// delay. It returns an error if NetworkManager isn't available.
+func watchNetwork(ctx context.Context) error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return err
+	}
+	var state uint32
+	if err := conn.Object(nmName, nmPath).StoreProperty(nmName+".State", &state); err != nil {
+		conn.Close()
+		return err
+	}
+	err = conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(nmPath),
+		dbus.WithMatchInterface(nmName),
+		dbus.WithMatchMember("StateChanged"))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	signals := make(chan *dbus.Signal, 8)
+	conn.Signal(signals)
+	go func() {
+		defer conn.Close()
+		followNetwork(ctx, state, signals, relayClient.Reconnect)
+	}()
+	return nil
+}
+
+// followNetwork calls reconnect whenever NetworkManager's state, starting at
+// state, changes to being connected, until the context is cancelled or the
+// signals stop.
+func followNetwork(ctx context.Context, state uint32, signals <-chan *dbus.Signal, reconnect func()) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig, ok := <-signals:
+			if !ok {
+				return
+			}
+			if len(sig.Body) != 1 {
+				continue
+			}
+			newState, ok := sig.Body[0].(uint32)
+			if !ok {
+				continue
+			}
+			log.WithField("state", newState).Debug("Network state changed.")
+			if newState >= nmStateGlobal && state < nmStateGlobal {
+				// any existing connection is probably dead
+				log.Info("Network connected.")
+				reconnect()
+			}
+			state = newState
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csw/semrelay/client"
+)
+
+// useStatusFile keeps the status in a temporary file until the test ends.
+func useStatusFile(t *testing.T) {
+	old := statusFile
+	statusFile = filepath.Join(t.TempDir(), "status.json")
+	t.Cleanup(func() { statusFile = old })
+}
+
+func useServer(t *testing.T) {
+	old := server
+	server = "relay.example.com"
+	t.Cleanup(func() { server = old })
+}
+
+func connectionStatus(t *testing.T) *connectionState {
+	state, err := readStatus()
+	require.NoError(t, err)
+	if state.Connection == nil {
+		return &connectionState{}
+	}
+	return state.Connection
+}
+
+func TestConnectionMonitorUnreachable(t *testing.T) {
+	useStatusFile(t)
+	useServer(t)
+	f := useBackend(t)
+	m := newConnectionMonitor(50 * time.Millisecond)
+	m.update(client.State{Since: time.Now(), LastError: errors.New("connection refused"), Attempts: 1})
+	require.Eventually(t, func() bool { return len(f.shown()) == 1 }, 2*time.Second, 5*time.Millisecond)
+	nt := f.shown()[0]
+	assert.Equal(t, "Can't reach relay.example.com", nt.Summary)
+	assert.Equal(t, "No connection for 50ms.\nconnection refused", nt.Body)
+	assert.True(t, nt.Failed)
+	assert.Equal(t, connectionTag, nt.Tag)
+	status := connectionStatus(t)
+	assert.Equal(t, connDisconnected, status.State)
+	assert.Equal(t, "connection refused", status.LastError)
+
+	m.update(client.State{Connected: true, Since: time.Now()})
+	require.Eventually(t, func() bool { return len(f.shown()) == 2 }, 2*time.Second, 5*time.Millisecond)
+	nt = f.shown()[1]
+	assert.Equal(t, "Reconnected to relay.example.com", nt.Summary)
+	assert.False(t, nt.Failed)
+	assert.Equal(t, connectionTag, nt.Tag)
+	assert.Equal(t, connConnected, connectionStatus(t).State)
+
+	m.stop()
+	assert.Equal(t, connStopped, connectionStatus(t).State)
+	assert.Len(t, f.shown(), 2)
+}
+
+func TestConnectionMonitorQuickReconnect(t *testing.T) {
+	useStatusFile(t)
+	useServer(t)
+	f := useBackend(t)
+	m := newConnectionMonitor(200 * time.Millisecond)
+	m.update(client.State{Connected: true, Since: time.Now()})
+	m.update(client.State{Since: time.Now(), LastError: errors.New("reset")})
+	time.Sleep(50 * time.Millisecond)
+	m.update(client.State{Connected: true, Since: time.Now()})
+	time.Sleep(300 * time.Millisecond)
+	m.stop()
+	assert.Empty(t, f.shown(), "no notices for a short outage")
+}
+
+func TestConnectionMonitorDisabled(t *testing.T) {
+	useStatusFile(t)
+	useServer(t)
+	f := useBackend(t)
+	m := newConnectionMonitor(0)
+	m.update(client.State{Since: time.Now(), LastError: errors.New("reset")})
+	time.Sleep(50 * time.Millisecond)
+	m.stop()
+	assert.Empty(t, f.shown())
+}
+
+// blockingNotifier is a backend whose Notify waits until it's released.
+type blockingNotifier struct {
+	fakeNotifier
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingNotifier) Notify(nt *notice) error {
+	b.entered <- struct{}{}
+	<-b.release
+	return b.fakeNotifier.Notify(nt)
+}
+
+func TestConnectionMonitorDoesNotBlock(t *testing.T) {
+	useStatusFile(t)
+	useServer(t)
+	b := &blockingNotifier{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	old := backend
+	backend = b
+	defer func() { backend = old }()
+
+	m := newConnectionMonitor(10 * time.Millisecond)
+	m.update(client.State{Since: time.Now()})
+	<-b.entered
+
+	// the monitor is stuck showing the notice, but the client isn't held up
+	updated := make(chan struct{})
+	go func() {
+		defer close(updated)
+		for i := 1; i <= 100; i++ {
+			m.update(client.State{Since: time.Now(), Attempts: i, LastError: errors.New("refused")})
+		}
+	}()
+	select {
+	case <-updated:
+	case <-time.After(2 * time.Second):
+		t.Fatal("update blocked")
+	}
+
+	close(b.release)
+	// only the latest state matters
+	require.Eventually(t, func() bool {
+		return connectionStatus(t).Attempts == 100
+	}, 2*time.Second, 5*time.Millisecond)
+	m.stop()
+	assert.Len(t, b.shown(), 1)
+}
+
+func networkSignal(body ...interface{}) *dbus.Signal {
+	return &dbus.Signal{Path: nmPath, Name: nmName + ".StateChanged", Body: body}
+}
+
+func TestFollowNetwork(t *testing.T) {
+	const (
+		disconnected = 20
+		connecting   = 40
+		site         = 60
+	)
+	signals := make(chan *dbus.Signal)
+	reconnects := make(chan struct{}, 8)
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		defer close(done)
+		followNetwork(ctx, nmStateGlobal, signals, func() { reconnects <- struct{}{} })
+	}()
+
+	for _, sig := range []*dbus.Signal{
+		// already connected
+		networkSignal(uint32(nmStateGlobal)),
+		networkSignal(uint32(disconnected)),
+		networkSignal(uint32(connecting)),
+		// ignored
+		networkSignal("connected"),
+		networkSignal(uint32(nmStateGlobal), uint32(0)),
+		networkSignal(uint32(nmStateGlobal)),
+		// back online
+		networkSignal(uint32(site)),
+		networkSignal(uint32(nmStateGlobal)),
+	} {
+		signals <- sig
+	}
+	cancel()
+	<-done
+	assert.Len(t, reconnects, 2)
+
+	// it also stops when the signals do
+	signals = make(chan *dbus.Signal)
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		followNetwork(context.Background(), disconnected, signals, func() { reconnects <- struct{}{} })
+	}()
+	close(signals)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("followNetwork didn't return")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/csw/semrelay"
+	"github.com/esiqveland/notify"
+	dbus "github.com/godbus/dbus/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const dbusName = "semrelay.Semnotify"
+
+var dConn *dbus.Conn
+var notifier notify.Notifier
+
+type registration struct {
+	id    uint32
+	msgId uint64
+	tag   string
+	// actions maps action keys to their handlers.
+	actions map[string]func() error
+}
+
+// registry associates DBus notification IDs with the relay message IDs and
+// the handlers for their actions, such as opening the Semaphore pipeline page
+// when the user clicks on a notification.
+var registry = make(map[uint32]registration)
+
+// displayed maps relay message IDs back to DBus notification IDs, so that
+// notifications dismissed on another device can be closed here.
+var displayed = make(map[uint64]uint32)
+
+// replaceMode is how a notification replaces the previous one for the same
+// project and branch.
+type replaceMode int
+
+const (
+	// replaceStackTag relies on the daemon grouping notifications by the
+	// x-dunst-stack-tag hint.
+	replaceStackTag replaceMode = iota
+	// replaceInPlace sends the new notification with the previous one's ID
+	// as ReplacesID.
+	replaceInPlace
+	// replaceReopen closes the previous notification and opens a new one,
+	// for daemons that update replaced notifications without showing them
+	// again.
+	replaceReopen
+)
+
+func (m replaceMode) String() string {
+	switch m {
+	case replaceStackTag:
+		return "by stack tag"
+	case replaceInPlace:
+		return "in place"
+	default:
+		return "by closing and reopening"
+	}
+}
+
+// reopenDaemons are notification daemons that quietly update a replaced
+// notification rather than showing it again.
+var reopenDaemons = map[string]bool{
+	"gnome-shell": true,
+}
+
+var replacement replaceMode
+
+// tagged maps each notification tag to the DBus ID of the latest
+// notification with it, to replace it with the next one.
+var tagged = struct {
+	sync.Mutex
+	ids map[string]uint32
+}{ids: make(map[string]uint32)}
+
+// chooseReplaceMode picks how to replace notifications based on what the
+// daemon supports.
+func chooseReplaceMode(server notify.ServerInformation, caps []string) replaceMode {
+	for _, c := range caps {
+		if c == "x-dunst-stack-tag" {
+			return replaceStackTag
+		}
+	}
+	if reopenDaemons[server.Name] {
+		return replaceReopen
+	}
+	return replaceInPlace
+}
+
+var registerCh = make(chan registration, 8)
+var clickCh = make(chan *notify.ActionInvokedSignal, 8)
+var closedCh = make(chan *notify.NotificationClosedSignal, 8)
+var remoteDismissCh = make(chan uint64, 8)
+
+var icon *DBusIcon
+
+// hasActions is whether the daemon supports actions besides the default.
+var hasActions bool
+
+// dbusNotifier shows notifications with the desktop notification daemon over
+// DBus. Clicking a notification opens the pipeline in the browser.
+type dbusNotifier struct{}
+
+func newDBusNotifier() (*dbusNotifier, error) {
+	if err := initDBus(); err != nil {
+		return nil, fmt.Errorf("DBus connection error: %w", err)
+	}
+	return &dbusNotifier{}, nil
+}
+
+func (*dbusNotifier) Notify(nt *notice) error {
+	urgency := dbus.MakeVariant(1) // Normal
+	if nt.Failed {
+		urgency = dbus.MakeVariant(byte(2)) // Critical
+	}
+	tagged.Lock()
+	var replacesID uint32
+	if prev, found := tagged.ids[nt.Tag]; found {
+		switch replacement {
+		case replaceInPlace:
+			replacesID = prev
+		case replaceReopen:
+			if _, err := notifier.CloseNotification(prev); err != nil {
+				log.WithError(err).Debug("Error closing previous notification.")
+			}
+		}
+	}
+	actions := noticeActions(nt)
+	if !hasActions {
+		actions = actions[:1]
+	}
+	handlers := make(map[string]func() error, len(actions))
+	var dActions []notify.Action
+	for _, a := range actions {
+		dActions = append(dActions, notify.Action{Key: a.key, Label: a.label})
+		handlers[a.key] = a.run
+	}
+	n := notify.Notification{
+		AppName:    "Semaphore",
+		ReplacesID: replacesID,
+		Summary:    nt.Summary,
+		Body:       nt.Body,
+		Actions:    dActions,
+		Hints: map[string]dbus.Variant{
+			"urgency":           urgency,
+			"x-dunst-stack-tag": dbus.MakeVariant(nt.Tag),
+			"image-data":        dbus.MakeVariant(icon),
+		},
+		ExpireTimeout: ttl,
+	}
+	id, err := notifier.SendNotification(n)
+	if err == nil {
+		tagged.ids[nt.Tag] = id
+	}
+	tagged.Unlock()
+	if err != nil {
+		return err
+	}
+	// Register the handlers to run when actions are invoked.
+	registerCh <- registration{id: id, msgId: nt.MsgId, tag: nt.Tag, actions: handlers}
+	return nil
+}
+
+// Dismiss closes the notification for the given relay message ID, which was
+// dismissed on another device.
+func (*dbusNotifier) Dismiss(msgId uint64) {
+	remoteDismissCh <- msgId
+}
+
+func (*dbusNotifier) Close() error {
+	return cleanupDBus()
+}
+
+func onAction(action *notify.ActionInvokedSignal) {
+	clickCh <- action
+}
+
+func onClosed(closed *notify.NotificationClosedSignal) {
+	closedCh <- closed
+}
+
+func forget(id uint32) (registration, bool) {
+	reg, found := registry[id]
+	if found {
+		delete(registry, id)
+		delete(displayed, reg.msgId)
+		tagged.Lock()
+		if tagged.ids[reg.tag] == id {
+			delete(tagged.ids, reg.tag)
+		}
+		tagged.Unlock()
+	}
+	return reg, found
+}
+
+func runHandler() {
+	for {
+		select {
+		case reg := <-registerCh:
+			if prev, found := registry[reg.id]; found {
+				// replaced in place
+				delete(displayed, prev.msgId)
+			}
+			registry[reg.id] = reg
+			displayed[reg.msgId] = reg.id
+		case invoked := <-clickCh:
+			reg, found := forget(invoked.ID)
+			if !found {
+				continue
+			}
+			sendDismiss(reg.msgId)
+			run, found := reg.actions[invoked.ActionKey]
+			if !found {
+				log.WithField("action", invoked.ActionKey).Warn("Unknown action invoked.")
+				continue
+			}
+			log.WithField("action", invoked.ActionKey).Debug("Running action.")
+			go func(key string) {
+				if err := run(); err != nil {
+					log.WithField("action", key).WithError(err).Error("Error running action.")
+				}
+			}(invoked.ActionKey)
+		case closed := <-closedCh:
+			reg, found := forget(closed.ID)
+			if !found {
+				continue
+			}
+			// Only propagate explicit dismissals; expiry is up to each device,
+			// and ReasonClosedByCall is the result of a remote dismissal.
+			if closed.Reason == notify.ReasonDismissedByUser {
+				sendDismiss(reg.msgId)
+			}
+		case msgId := <-remoteDismissCh:
+			id, found := displayed[msgId]
+			if !found {
+				continue
+			}
+			forget(id)
+			log.WithField("id", msgId).Debug("Closing notification dismissed elsewhere.")
+			if _, err := notifier.CloseNotification(id); err != nil {
+				log.WithError(err).Error("Error closing notification.")
+			}
+		}
+	}
+}
+
+func initDBus() error {
+	var err error
+	dConn, err = dbus.SessionBusPrivate()
+	if err != nil {
+		return err
+	}
+
+	if err = dConn.Auth(nil); err != nil {
+		dConn.Close()
+		return err
+	}
+
+	if err = dConn.Hello(); err != nil {
+		dConn.Close()
+		return err
+	}
+
+	reply, err := dConn.RequestName(dbusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return err
+	}
+	if reply == dbus.RequestNameReplyExists {
+		return errors.New("semnotify already running and registered with DBus")
+	} else if reply != dbus.RequestNameReplyPrimaryOwner {
+		return fmt.Errorf("failed to acquire DBus name: RequestNameReply %d", reply)
+	}
+
+	notifier, err = notify.New(dConn,
+		notify.WithOnAction(onAction),
+		notify.WithOnClosed(onClosed))
+	if err != nil {
+		dConn.Close()
+		return err
+	}
+	server, err := notifier.GetServerInformation()
+	if err != nil {
+		dConn.Close()
+		return err
+	}
+	log.Debugf("Notification daemon: %s (%s), version %s, specification version %s\n",
+		server.Name, server.Vendor, server.Version, server.SpecVersion)
+	caps, err := notifier.GetCapabilities()
+	if err != nil {
+		dConn.Close()
+		return err
+	}
+	log.Debugf("Notification daemon capabilities: %s\n", strings.Join(caps, ", "))
+	replacement = chooseReplaceMode(server, caps)
+	for _, c := range caps {
+		if c == "actions" {
+			hasActions = true
+		}
+	}
+	log.Debugf("Replacing notifications %s.", replacement)
+
+	icon = buildIcon(semrelay.IconImage)
+
+	go runHandler()
+
+	return nil
+}
+
+func cleanupDBus() error {
+	if err := notifier.Close(); err != nil {
+		log.WithError(err).Error("Error closing notifier.")
+	}
+	if err := dConn.Close(); err != nil {
+		log.WithError(err).Error("Error closing DBus connection.")
+		return err
+	}
+	return nil
+}
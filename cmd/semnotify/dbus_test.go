@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/esiqveland/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChooseReplaceMode(t *testing.T) {
+	for _, tc := range []struct {
+		server string
+		caps   []string
+		want   replaceMode
+	}{
+		{"dunst", []string{"body", "x-dunst-stack-tag", "actions"}, replaceStackTag},
+		// the capability wins over the server name
+		{"gnome-shell", []string{"x-dunst-stack-tag"}, replaceStackTag},
+		{"gnome-shell", []string{"body", "actions", "persistence"}, replaceReopen},
+		{"gnome-shell", nil, replaceReopen},
+		{"Plasma", []string{"body", "actions"}, replaceInPlace},
+		{"mako", nil, replaceInPlace},
+		{"", nil, replaceInPlace},
+	} {
+		got := chooseReplaceMode(notify.ServerInformation{Name: tc.server}, tc.caps)
+		assert.Equal(t, tc.want, got, "%s %v", tc.server, tc.caps)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/csw/semrelay"
+)
+
+// seenRetention is how long to remember shown notifications.
+const seenRetention = 7 * 24 * time.Hour
+
+// seenStore remembers the notifications shown recently, by relay message ID
+// and by pipeline and result, so that notifications redelivered after a lost
+// ack, or sent twice by Semaphore, aren't shown again. It's saved in a file so
+// that this works across restarts.
+type seenStore struct {
+	path string
+
+	mu        sync.Mutex
+	Messages  map[uint64]time.Time `json:"messages"`
+	Pipelines map[string]time.Time `json:"pipelines"`
+}
+
+// seen is set while the client is running.
+var seen *seenStore
+
+func loadSeen(path string) (*seenStore, error) {
+	s := &seenStore{
+		path:      path,
+		Messages:  make(map[uint64]time.Time),
+		Pipelines: make(map[string]time.Time),
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, s); err != nil {
+		log.WithError(err).Warn("Ignoring invalid list of shown notifications.")
+	}
+	if s.Messages == nil {
+		s.Messages = make(map[uint64]time.Time)
+	}
+	if s.Pipelines == nil {
+		s.Pipelines = make(map[string]time.Time)
+	}
+	return s, nil
+}
+
+// pipelineKey identifies the pipeline and result, or is empty if the
+// notification has no pipeline ID, so that such notifications aren't taken
+// for each other.
+func pipelineKey(semN *semrelay.Notification) string {
+	if semN.Pipeline.Id == "" {
+		return ""
+	}
+	return semN.Pipeline.Id + "/" + semN.Pipeline.Result
+}
+
+// duplicate reports whether the notification was already shown.
+func (s *seenStore) duplicate(msgId uint64, semN *semrelay.Notification) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.Messages[msgId]; found {
+		return true
+	}
+	key := pipelineKey(semN)
+	if key == "" {
+		return false
+	}
+	_, found := s.Pipelines[key]
+	return found
+}
+
+// record remembers that the notification was shown, saving the list.
+func (s *seenStore) record(msgId uint64, semN *semrelay.Notification) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.Messages[msgId] = now
+	if key := pipelineKey(semN); key != "" {
+		s.Pipelines[key] = now
+	}
+	cutoff := now.Add(-seenRetention)
+	for id, t := range s.Messages {
+		if t.Before(cutoff) {
+			delete(s.Messages, id)
+		}
+	}
+	for key, t := range s.Pipelines {
+		if t.Before(cutoff) {
+			delete(s.Pipelines, key)
+		}
+	}
+	enc, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		log.WithError(err).Error("Error creating state directory.")
+		return
+	}
+	if err := writeFileAtomic(s.path, append(enc, '\n')); err != nil {
+		log.WithError(err).Error("Error saving shown notifications.")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csw/semrelay"
+)
+
+func pipelineNotification(id, result string) *semrelay.Notification {
+	var n semrelay.Notification
+	n.Pipeline.Id = id
+	n.Pipeline.Result = result
+	return &n
+}
+
+func TestSeenDuplicate(t *testing.T) {
+	s, err := loadSeen(filepath.Join(t.TempDir(), "state", "seen.json"))
+	require.NoError(t, err)
+	failed := pipelineNotification("p1", semrelay.ResultFailed)
+	assert.False(t, s.duplicate(1, failed))
+	s.record(1, failed)
+
+	// redelivered by the relay
+	assert.True(t, s.duplicate(1, failed))
+	// sent twice by Semaphore
+	assert.True(t, s.duplicate(2, failed))
+	// a different result for the same pipeline, after a rerun
+	assert.False(t, s.duplicate(3, pipelineNotification("p1", semrelay.ResultPassed)))
+	assert.False(t, s.duplicate(4, pipelineNotification("p2", semrelay.ResultFailed)))
+}
+
+func TestSeenWithoutPipelineId(t *testing.T) {
+	s, err := loadSeen(filepath.Join(t.TempDir(), "seen.json"))
+	require.NoError(t, err)
+	s.record(1, pipelineNotification("", semrelay.ResultFailed))
+	assert.Empty(t, s.Pipelines)
+	assert.True(t, s.duplicate(1, pipelineNotification("", semrelay.ResultFailed)))
+	assert.False(t, s.duplicate(2, pipelineNotification("", semrelay.ResultFailed)))
+}
+
+func TestSeenReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seen.json")
+	s, err := loadSeen(path)
+	require.NoError(t, err)
+	s.record(1, pipelineNotification("p1", semrelay.ResultFailed))
+
+	// after a restart
+	s, err = loadSeen(path)
+	require.NoError(t, err)
+	assert.True(t, s.duplicate(1, pipelineNotification("p9", semrelay.ResultPassed)))
+	assert.True(t, s.duplicate(2, pipelineNotification("p1", semrelay.ResultFailed)))
+
+	require.NoError(t, os.WriteFile(path, []byte("{not json"), 0o600))
+	s, err = loadSeen(path)
+	require.NoError(t, err, "an invalid file is ignored")
+	assert.False(t, s.duplicate(1, pipelineNotification("p1", semrelay.ResultFailed)))
+}
+
+func TestSeenPrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seen.json")
+	s, err := loadSeen(path)
+	require.NoError(t, err)
+	s.record(1, pipelineNotification("p1", semrelay.ResultFailed))
+	s.record(2, pipelineNotification("p2", semrelay.ResultFailed))
+	// age the first notification past the retention period
+	old := time.Now().Add(-seenRetention - time.Minute)
+	s.Messages[1] = old
+	s.Pipelines["p1/failed"] = old
+	s.record(3, pipelineNotification("p3", semrelay.ResultFailed))
+
+	s, err = loadSeen(path)
+	require.NoError(t, err)
+	assert.False(t, s.duplicate(1, pipelineNotification("p1", semrelay.ResultFailed)))
+	assert.True(t, s.duplicate(2, pipelineNotification("p2", semrelay.ResultFailed)))
+	assert.True(t, s.duplicate(3, pipelineNotification("p3", semrelay.ResultFailed)))
+	assert.Len(t, s.Messages, 2)
+	assert.Len(t, s.Pipelines, 2)
+}
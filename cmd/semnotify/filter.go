@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/csw/semrelay"
+)
+
+// filterRule includes or excludes notifications matching all of its
+// patterns. Empty patterns match anything; others are matched with
+// path.Match.
+type filterRule struct {
+	Action     string `mapstructure:"action"`
+	Project    string `mapstructure:"project"`
+	Repository string `mapstructure:"repository"`
+	Branch     string `mapstructure:"branch"`
+	Result     string `mapstructure:"result"`
+	YamlFile   string `mapstructure:"yaml_file"`
+	// Promotion matches only promotions if true, or only initial pipelines if
+	// false.
+	Promotion *bool `mapstructure:"promotion"`
+}
+
+var filters []*filterRule
+
+func loadFilters() error {
+	if err := viper.UnmarshalKey("filters", &filters); err != nil {
+		return fmt.Errorf("invalid filters: %w", err)
+	}
+	for _, f := range filters {
+		if f.Action != "include" && f.Action != "exclude" {
+			return fmt.Errorf("filter action must be include or exclude, not %q", f.Action)
+		}
+		for _, pattern := range []string{f.Project, f.Repository, f.Branch, f.Result, f.YamlFile} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid filter pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (f *filterRule) matches(semN *semrelay.Notification) bool {
+	if f.Promotion != nil && *f.Promotion != semN.IsPromotion() {
+		return false
+	}
+	return globMatch(f.Project, semN.Project.Name) &&
+		globMatch(f.Repository, semN.Repository.Slug) &&
+		globMatch(f.Branch, semN.Revision.Branch.Name) &&
+		globMatch(f.Result, semN.Pipeline.Result) &&
+		globMatch(f.YamlFile, semN.Pipeline.YamlFileName)
+}
+
+// included reports whether the notification should be shown. The first
+// matching rule decides; notifications matching no rule are shown.
+func included(semN *semrelay.Notification) bool {
+	for _, f := range filters {
+		if f.matches(semN) {
+			return f.Action == "include"
+		}
+	}
+	return true
+}
+
+// quietHours holds notifications arriving during a daily window, to show a
+// summary of them when it ends. The window is in local time, and may span
+// midnight. Held notifications are saved in a file, if path is set, so that
+// they're still shown after a restart.
+type quietHours struct {
+	// start and end are minutes after midnight.
+	start, end int
+	path       string
+
+	mu   sync.Mutex
+	held []*notice
+}
+
+var quiet *quietHours
+
+// parseQuietHours parses a window like "22:00-07:00".
+func parseQuietHours(spec string) (*quietHours, error) {
+	startSpec, endSpec, ok := strings.Cut(spec, "-")
+	if !ok {
+		return nil, fmt.Errorf("quiet hours must be like 22:00-07:00, not %q", spec)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(startSpec))
+	if err != nil {
+		return nil, fmt.Errorf("invalid quiet hours start: %w", err)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(endSpec))
+	if err != nil {
+		return nil, fmt.Errorf("invalid quiet hours end: %w", err)
+	}
+	return &quietHours{
+		start: start.Hour()*60 + start.Minute(),
+		end:   end.Hour()*60 + end.Minute(),
+	}, nil
+}
+
+func (q *quietHours) active(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if q.start <= q.end {
+		return q.start <= m && m < q.end
+	}
+	return m >= q.start || m < q.end
+}
+
+// nextEnd returns the next end of the window after t.
+func (q *quietHours) nextEnd(t time.Time) time.Time {
+	end := time.Date(t.Year(), t.Month(), t.Day(), q.end/60, q.end%60, 0, 0, t.Location())
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+// loadHeld reads the notices held before a restart.
+func (q *quietHours) loadHeld() error {
+	if q.path == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := json.Unmarshal(raw, &q.held); err != nil {
+		log.WithError(err).Warn("Ignoring invalid list of held notifications.")
+		q.held = nil
+	}
+	return nil
+}
+
+// save writes the held notices to the file, or removes it if there are none.
+// It's called with mu held.
+func (q *quietHours) save() {
+	if q.path == "" {
+		return
+	}
+	if len(q.held) == 0 {
+		if err := os.Remove(q.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.WithError(err).Error("Error removing held notifications.")
+		}
+		return
+	}
+	enc, err := json.Marshal(q.held)
+	if err != nil {
+		panic(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(q.path), 0o700); err != nil {
+		log.WithError(err).Error("Error creating state directory.")
+		return
+	}
+	if err := writeFileAtomic(q.path, append(enc, '\n')); err != nil {
+		log.WithError(err).Error("Error saving held notifications.")
+	}
+}
+
+// hold keeps the notice for the summary if quiet hours are in effect.
+func (q *quietHours) hold(nt *notice) bool {
+	if !q.active(time.Now()) {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.held = append(q.held, nt)
+	q.save()
+	return true
+}
+
+// run shows the summary at the end of each window until the context is
+// cancelled.
+func (q *quietHours) run(ctx context.Context) {
+	if !q.active(time.Now()) {
+		// the window ended while semnotify wasn't running
+		q.flush()
+	}
+	for {
+		timer := time.NewTimer(time.Until(q.nextEnd(time.Now())))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			q.flush()
+		}
+	}
+}
+
+func (q *quietHours) flush() {
+	q.mu.Lock()
+	held := q.held
+	q.held = nil
+	q.save()
+	q.mu.Unlock()
+	if len(held) == 0 {
+		return
+	}
+	summary := quietSummary(held)
+	log.WithField("held", len(held)).Info("Showing quiet hours summary")
+	if err := backend.Notify(summary); err != nil {
+		log.WithError(err).Error("Error showing quiet hours summary.")
+	}
+}
+
+// quietSummary combines notices held during quiet hours into one, linking to
+// the latest failure if there was one, or else the latest build.
+func quietSummary(held []*notice) *notice {
+	var failed int
+	var lines []string
+	latest := held[len(held)-1]
+	for _, nt := range held {
+		lines = append(lines, nt.Summary)
+		if nt.Failed {
+			failed++
+			latest = nt
+		}
+	}
+	summary := fmt.Sprintf("%d builds during quiet hours", len(held))
+	if len(held) == 1 {
+		summary = "1 build during quiet hours"
+	}
+	if failed > 0 {
+		summary += fmt.Sprintf(", %d failed", failed)
+	}
+	return &notice{
+		Summary: summary,
+		Body:    strings.Join(lines, "\n") + "\n",
+		URL:     latest.URL,
+		Failed:  failed > 0,
+		Tag:     "quiet-hours",
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csw/semrelay"
+)
+
+// fakeNotifier records the notices it's asked to show.
+type fakeNotifier struct {
+	mu      sync.Mutex
+	notices []*notice
+}
+
+func (f *fakeNotifier) Notify(nt *notice) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.notices = append(f.notices, nt)
+	return nil
+}
+
+func (f *fakeNotifier) Dismiss(msgId uint64) {}
+func (f *fakeNotifier) Close() error         { return nil }
+
+func (f *fakeNotifier) shown() []*notice {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*notice(nil), f.notices...)
+}
+
+// useBackend makes a fakeNotifier the backend until the test ends.
+func useBackend(t *testing.T) *fakeNotifier {
+	f := &fakeNotifier{}
+	old := backend
+	backend = f
+	t.Cleanup(func() { backend = old })
+	return f
+}
+
+func filterNotification(repository, branch, result string, promotion bool) *semrelay.Notification {
+	var n semrelay.Notification
+	n.Project.Name = path.Base(repository)
+	n.Repository.Slug = repository
+	n.Revision.Branch.Name = branch
+	n.Pipeline.Result = result
+	n.Pipeline.Id = "p2"
+	n.Workflow.InitialPipelineId = "p2"
+	if promotion {
+		n.Workflow.InitialPipelineId = "p1"
+	}
+	return &n
+}
+
+func TestIncluded(t *testing.T) {
+	defer func() { filters = nil }()
+	useConfig(t, `
+filters:
+  - action: include
+    project: semrelay
+    result: failed
+  - action: exclude
+    branch: dependabot/*
+  - action: exclude
+    promotion: true
+  - action: include
+    repository: csw/*
+  - action: exclude
+`)
+	require.NoError(t, loadFilters())
+	for _, tc := range []struct {
+		name     string
+		n        *semrelay.Notification
+		included bool
+	}{
+		// matches every rule, so the first decides
+		{"first rule", filterNotification("csw/semrelay", "dependabot/go", "failed", true), true},
+		{"second rule", filterNotification("csw/semrelay", "dependabot/go", "passed", false), false},
+		{"promotion", filterNotification("csw/semrelay", "main", "passed", true), false},
+		{"repository", filterNotification("csw/tools", "main", "passed", false), true},
+		{"catch-all", filterNotification("someone/tools", "main", "failed", false), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.included, included(tc.n))
+		})
+	}
+
+	filters = nil
+	assert.True(t, included(filterNotification("someone/tools", "main", "failed", false)), "no rules")
+}
+
+func TestLoadFiltersErrors(t *testing.T) {
+	defer func() { filters = nil }()
+	for name, contents := range map[string]string{
+		"no action":   "filters: [{project: x}]\n",
+		"bad action":  "filters: [{action: show}]\n",
+		"bad pattern": "filters: [{action: include, branch: '['}]\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			useConfig(t, contents)
+			assert.Error(t, loadFilters())
+		})
+	}
+}
+
+func at(hour, minute int) time.Time {
+	return time.Date(2024, 3, 9, hour, minute, 0, 0, time.Local)
+}
+
+func TestParseQuietHours(t *testing.T) {
+	q, err := parseQuietHours(" 22:30 - 07:00 ")
+	require.NoError(t, err)
+	assert.Equal(t, 22*60+30, q.start)
+	assert.Equal(t, 7*60, q.end)
+	for _, spec := range []string{"22:00", "22-07", "22:00-25:00", "x-07:00"} {
+		_, err := parseQuietHours(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestQuietHoursActive(t *testing.T) {
+	overnight, err := parseQuietHours("22:00-07:00")
+	require.NoError(t, err)
+	daytime, err := parseQuietHours("12:00-13:30")
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		t                  time.Time
+		overnight, daytime bool
+	}{
+		{at(21, 59), false, false},
+		{at(22, 0), true, false},
+		{at(23, 59), true, false},
+		{at(0, 0), true, false},
+		{at(6, 59), true, false},
+		{at(7, 0), false, false},
+		{at(12, 0), false, true},
+		{at(13, 29), false, true},
+		{at(13, 30), false, false},
+	} {
+		name := tc.t.Format("15:04")
+		assert.Equal(t, tc.overnight, overnight.active(tc.t), "overnight at "+name)
+		assert.Equal(t, tc.daytime, daytime.active(tc.t), "daytime at "+name)
+	}
+}
+
+func TestQuietHoursNextEnd(t *testing.T) {
+	q, err := parseQuietHours("22:00-07:00")
+	require.NoError(t, err)
+	tomorrow := time.Date(2024, 3, 10, 7, 0, 0, 0, time.Local)
+	today := time.Date(2024, 3, 9, 7, 0, 0, 0, time.Local)
+	for _, tc := range []struct {
+		t    time.Time
+		want time.Time
+	}{
+		{at(22, 0), tomorrow},
+		{at(23, 59), tomorrow},
+		{at(0, 30), today},
+		{at(6, 59), today},
+		// at the end, the next end is a day away
+		{at(7, 0), tomorrow},
+		{at(12, 0), tomorrow},
+	} {
+		assert.Equal(t, tc.want, q.nextEnd(tc.t), tc.t.Format("15:04"))
+	}
+}
+
+func TestQuietSummary(t *testing.T) {
+	one := quietSummary([]*notice{{Summary: "a passed", URL: "https://a"}})
+	assert.Equal(t, "1 build during quiet hours", one.Summary)
+	assert.Equal(t, "a passed\n", one.Body)
+	assert.Equal(t, "https://a", one.URL)
+	assert.False(t, one.Failed)
+
+	several := quietSummary([]*notice{
+		{Summary: "a failed", URL: "https://a", Failed: true},
+		{Summary: "b failed", URL: "https://b", Failed: true},
+		{Summary: "c passed", URL: "https://c"},
+	})
+	assert.Equal(t, "3 builds during quiet hours, 2 failed", several.Summary)
+	assert.Equal(t, "a failed\nb failed\nc passed\n", several.Body)
+	// the latest failure rather than the latest build
+	assert.Equal(t, "https://b", several.URL)
+	assert.True(t, several.Failed)
+}
+
+// allDay is a window that's always active, except in the minute before
+// midnight.
+func allDay(t *testing.T, path string) *quietHours {
+	q, err := parseQuietHours("00:00-23:59")
+	require.NoError(t, err)
+	if !q.active(time.Now()) {
+		t.Skip("outside the test window")
+	}
+	q.path = path
+	return q
+}
+
+func TestQuietHoursPersist(t *testing.T) {
+	f := useBackend(t)
+	path := filepath.Join(t.TempDir(), "state", "held.json")
+	q := allDay(t, path)
+	require.NoError(t, q.loadHeld())
+	assert.True(t, q.hold(&notice{Summary: "a failed", Failed: true}))
+	assert.True(t, q.hold(&notice{Summary: "b passed"}))
+	assert.FileExists(t, path)
+
+	// after a restart
+	q = allDay(t, path)
+	require.NoError(t, q.loadHeld())
+	q.flush()
+	shown := f.shown()
+	require.Len(t, shown, 1)
+	assert.Equal(t, "2 builds during quiet hours, 1 failed", shown[0].Summary)
+	assert.NoFileExists(t, path)
+
+	q = allDay(t, path)
+	require.NoError(t, q.loadHeld())
+	q.flush()
+	assert.Len(t, f.shown(), 1, "nothing held after the summary")
+}
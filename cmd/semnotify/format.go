@@ -1,46 +1,184 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
+	"text/template"
 	"time"
 
+	"github.com/spf13/viper"
+
 	"github.com/csw/semrelay"
+	internal "github.com/csw/semrelay/internal"
 )
 
 func title(semN *semrelay.Notification) (string, error) {
-	startT, err := time.Parse(time.RFC3339, semN.Pipeline.RunningAt)
-	if err != nil {
-		return "", err
+	if t := templateFor(semN, func(ts *templateSet) *template.Template { return ts.summary }); t != nil {
+		return execute(t, semN)
 	}
-	doneT, err := time.Parse(time.RFC3339, semN.Pipeline.DoneAt)
+	duration, err := semN.Duration()
 	if err != nil {
 		return "", err
 	}
-	mins := doneT.Sub(startT).Minutes()
 	return fmt.Sprintf("Build %s for %s:%s in %.0fm",
-		semN.Pipeline.Result, semN.Project.Name, semN.Revision.Branch.Name, mins), nil
+		semN.Pipeline.Result, semN.Project.Name, semN.Revision.Branch.Name,
+		duration.Minutes()), nil
+}
+
+func body(semN *semrelay.Notification) (string, error) {
+	if t := templateFor(semN, func(ts *templateSet) *template.Template { return ts.body }); t != nil {
+		return execute(t, semN)
+	}
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "Commit %s: %s\n", semN.ShortSHA(), semN.Revision.CommitMessage)
+	if semN.Failed() {
+		fmt.Fprintf(&b, "Failed in %s\n", failedJobs(semN))
+	}
+	return b.String(), nil
+}
+
+// failedJobs describes the failed jobs by block, e.g. "Test (unit, lint)".
+func failedJobs(semN *semrelay.Notification) string {
+	blockParts := []string{}
+	for _, block := range semN.Blocks {
+		jobParts := []string{}
+		for _, job := range block.FailedJobs() {
+			jobParts = append(jobParts, job.Name)
+		}
+		if len(jobParts) > 0 {
+			blockParts = append(blockParts,
+				fmt.Sprintf("%s (%s)", block.Name, strings.Join(jobParts, ", ")))
+		}
+	}
+	return strings.Join(blockParts, ", ")
+}
+
+// templateSet is a user-supplied summary and body template. Either may be
+// nil, to use the default.
+type templateSet struct {
+	summary, body *template.Template
+}
+
+// templateConfig is the templates setting. Templates under results are used
+// for notifications with that result, in preference to the general ones.
+type templateConfig struct {
+	Summary string `mapstructure:"summary"`
+	Body    string `mapstructure:"body"`
+	Results map[string]struct {
+		Summary string `mapstructure:"summary"`
+		Body    string `mapstructure:"body"`
+	} `mapstructure:"results"`
+}
+
+var (
+	templates       templateSet
+	resultTemplates map[string]*templateSet
+)
+
+var templateFuncs = template.FuncMap{
+	"duration":   formatDuration,
+	"shortSHA":   shortSHA,
+	"failedJobs": failedJobs,
+	"truncate":   truncate,
+}
+
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+// truncate shortens s to at most n characters, ending it with an ellipsis if
+// it was longer.
+func truncate(n int, s string) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	if n < 1 {
+		return ""
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// loadTemplates parses the configured templates and checks that they work
+// with the example notifications, so that mistakes are reported at startup
+// rather than when a build finishes.
+func loadTemplates() error {
+	var cfg templateConfig
+	if err := viper.UnmarshalKey("templates", &cfg); err != nil {
+		return fmt.Errorf("invalid templates: %w", err)
+	}
+	var err error
+	if templates, err = parseTemplateSet("", cfg.Summary, cfg.Body); err != nil {
+		return err
+	}
+	resultTemplates = make(map[string]*templateSet)
+	for result, rcfg := range cfg.Results {
+		ts, err := parseTemplateSet(result+" ", rcfg.Summary, rcfg.Body)
+		if err != nil {
+			return err
+		}
+		resultTemplates[result] = &ts
+	}
+	for _, example := range [][]byte{internal.ExampleSuccess, internal.ExampleFailure} {
+		var semN semrelay.Notification
+		if err := json.Unmarshal(example, &semN); err != nil {
+			panic(err)
+		}
+		if _, err := title(&semN); err != nil {
+			return err
+		}
+		if _, err := body(&semN); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func body(semN *semrelay.Notification) string {
+func parseTemplateSet(prefix, summary, body string) (templateSet, error) {
+	var ts templateSet
+	var err error
+	if summary != "" {
+		if ts.summary, err = parseTemplate(prefix+"summary", summary); err != nil {
+			return ts, err
+		}
+	}
+	if body != "" {
+		if ts.body, err = parseTemplate(prefix+"body", body); err != nil {
+			return ts, err
+		}
+	}
+	return ts, nil
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+	return t, nil
+}
+
+// templateFor returns the template to use for the notification, or nil for
+// the default format.
+func templateFor(semN *semrelay.Notification, get func(*templateSet) *template.Template) *template.Template {
+	if ts, ok := resultTemplates[semN.Pipeline.Result]; ok && get(ts) != nil {
+		return get(ts)
+	}
+	return get(&templates)
+}
+
+func execute(t *template.Template, semN *semrelay.Notification) (string, error) {
 	b := strings.Builder{}
-	fmt.Fprintf(&b, "Commit %s: %s\n",
-		semN.Revision.CommitSHA[:7], semN.Revision.CommitMessage)
-	if semN.Pipeline.Result == "failed" {
-		blockParts := []string{}
-		for _, block := range semN.Blocks {
-			jobParts := []string{}
-			for _, job := range block.Jobs {
-				if job.Result == "failed" {
-					jobParts = append(jobParts, job.Name)
-				}
-			}
-			if len(jobParts) > 0 {
-				blockParts = append(blockParts,
-					fmt.Sprintf("%s (%s)", block.Name, strings.Join(jobParts, ", ")))
-			}
-		}
-		fmt.Fprintf(&b, "Failed in %s\n", strings.Join(blockParts, ", "))
-	}
-	return b.String()
+	if err := t.Execute(&b, semN); err != nil {
+		return "", fmt.Errorf("formatting notification: %w", err)
+	}
+	return b.String(), nil
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csw/semrelay"
+	internal "github.com/csw/semrelay/internal"
+)
+
+func parseExample(t *testing.T, raw []byte) *semrelay.Notification {
+	var n semrelay.Notification
+	require.NoError(t, json.Unmarshal(raw, &n))
+	return &n
+}
+
+// useTemplates loads the templates in the configuration, going back to the
+// defaults when the test ends.
+func useTemplates(t *testing.T, contents string) error {
+	t.Cleanup(func() {
+		templates = templateSet{}
+		resultTemplates = nil
+	})
+	useConfig(t, contents)
+	return loadTemplates()
+}
+
+func TestDefaultFormat(t *testing.T) {
+	require.NoError(t, useTemplates(t, ""))
+	success := parseExample(t, internal.ExampleSuccess)
+	failure := parseExample(t, internal.ExampleFailure)
+
+	s, err := title(success)
+	require.NoError(t, err)
+	assert.Equal(t, "Build passed for myproject:notify_test in 4m", s)
+	s, err = body(success)
+	require.NoError(t, err)
+	assert.Equal(t, "Commit e97080e: more nothing\n", s)
+	s, err = body(failure)
+	require.NoError(t, err)
+	assert.Equal(t, "Commit e97080e: more nothing\nFailed in Test (Run tests)\n", s)
+}
+
+func TestTemplates(t *testing.T) {
+	require.NoError(t, useTemplates(t, `
+templates:
+  summary: "{{.Project.Name}} {{.Pipeline.Result}}"
+  results:
+    failed:
+      summary: "{{.Project.Name}} broke {{.Revision.Branch.Name}} after {{duration .Duration}}"
+      body: "{{failedJobs .}} at {{shortSHA .Revision.CommitSHA}}: {{truncate 4 .Revision.CommitMessage}}"
+`))
+	success := parseExample(t, internal.ExampleSuccess)
+	failure := parseExample(t, internal.ExampleFailure)
+
+	s, err := title(success)
+	require.NoError(t, err)
+	assert.Equal(t, "myproject passed", s)
+	// no body template for passed builds, or in general
+	s, err = body(success)
+	require.NoError(t, err)
+	assert.Equal(t, "Commit e97080e: more nothing\n", s)
+
+	s, err = title(failure)
+	require.NoError(t, err)
+	assert.Equal(t, "otherproject broke notify_test after 2m11s", s)
+	s, err = body(failure)
+	require.NoError(t, err)
+	assert.Equal(t, "Test (Run tests) at e97080e: mor…", s)
+}
+
+func TestTemplateFallback(t *testing.T) {
+	require.NoError(t, useTemplates(t, `
+templates:
+  body: "general"
+  results:
+    failed:
+      summary: "failed summary"
+`))
+	failure := parseExample(t, internal.ExampleFailure)
+	s, err := title(failure)
+	require.NoError(t, err)
+	assert.Equal(t, "failed summary", s)
+	// falls back to the general template, not the default format
+	s, err = body(failure)
+	require.NoError(t, err)
+	assert.Equal(t, "general", s)
+}
+
+func TestTemplateErrors(t *testing.T) {
+	for name, contents := range map[string]string{
+		"syntax":           "templates: {summary: '{{.Project.Name'}\n",
+		"unknown function": "templates: {body: '{{upper .Project.Name}}'}\n",
+		"unknown field":    "templates: {summary: '{{.Nope}}'}\n",
+		"result syntax":    "templates: {results: {failed: {body: '{{if}}'}}}\n",
+		"bad arguments":    "templates: {results: {passed: {summary: '{{truncate .Project.Name 3}}'}}}\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, useTemplates(t, contents))
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		n    int
+		s    string
+		want string
+	}{
+		{10, "short", "short"},
+		{5, "exact", "exact"},
+		{5, "longer text", "long…"},
+		{1, "ab", "…"},
+		{0, "ab", ""},
+		{0, "", ""},
+		{3, "héllo", "hé…"},
+		{2, "日本語", "日…"},
+	} {
+		assert.Equal(t, tc.want, truncate(tc.n, tc.s), "truncate %d %q", tc.n, tc.s)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/csw/semrelay"
+)
+
+// historyEntry is a notification received from the relay.
+type historyEntry struct {
+	// Seq numbers the entries, to refer to them in semnotify history.
+	Seq          int             `json:"seq"`
+	ReceivedAt   time.Time       `json:"received_at"`
+	MsgId        uint64          `json:"id,string"`
+	Notification json.RawMessage `json:"notification"`
+}
+
+// historyStore keeps received notifications in a JSON lines file, keeping at
+// most max entries, and none older than maxAge if it's set.
+type historyStore struct {
+	path   string
+	max    int
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	count   int
+	nextSeq int
+}
+
+// history is set if the history is enabled.
+var history *historyStore
+
+func newHistoryStore(dir string, max int, maxAge time.Duration) *historyStore {
+	return &historyStore{
+		path:    filepath.Join(dir, "history.jsonl"),
+		max:     max,
+		maxAge:  maxAge,
+		nextSeq: 1,
+	}
+}
+
+// open prepares the history for adding entries, pruning old ones. Only the
+// running client does this, so that it's the only one to write the file.
+func (h *historyStore) open() error {
+	if err := os.MkdirAll(filepath.Dir(h.path), 0o700); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.prune()
+}
+
+// read returns all of the entries, oldest first.
+func (h *historyStore) read() ([]*historyEntry, error) {
+	f, err := os.Open(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []*historyEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var e historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// skip a line truncated by a crash
+			log.WithError(err).Warn("Skipping invalid history entry.")
+			continue
+		}
+		entries = append(entries, &e)
+	}
+	return entries, scanner.Err()
+}
+
+// prune rewrites the history without the entries beyond the limits. It's
+// called with mu held.
+func (h *historyStore) prune() error {
+	entries, err := h.read()
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		h.nextSeq = entries[len(entries)-1].Seq + 1
+	}
+	start := 0
+	if len(entries) > h.max {
+		start = len(entries) - h.max
+	}
+	if h.maxAge > 0 {
+		cutoff := time.Now().Add(-h.maxAge)
+		for start < len(entries) && entries[start].ReceivedAt.Before(cutoff) {
+			start++
+		}
+	}
+	h.count = len(entries) - start
+	if start == 0 {
+		return nil
+	}
+	log.WithField("removed", start).Debug("Pruning history.")
+	var buf strings.Builder
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries[start:] {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(h.path, []byte(buf.String()))
+}
+
+// add appends a notification to the history.
+func (h *historyStore) add(msgId uint64, payload []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	enc, err := json.Marshal(&historyEntry{
+		Seq:          h.nextSeq,
+		ReceivedAt:   time.Now(),
+		MsgId:        msgId,
+		Notification: payload,
+	})
+	if err != nil {
+		log.WithError(err).Error("Error encoding history entry.")
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		log.WithError(err).Error("Error opening history.")
+		return
+	}
+	_, err = f.Write(append(enc, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.WithError(err).Error("Error writing history.")
+		return
+	}
+	h.nextSeq++
+	h.count++
+	// prune occasionally rather than rewriting the file every time
+	if h.count > h.max+h.max/10 {
+		if err := h.prune(); err != nil {
+			log.WithError(err).Error("Error pruning history.")
+		}
+	}
+}
+
+// historyOptions select history entries.
+type historyOptions struct {
+	project string
+	branch  string
+	failed  bool
+	since   time.Time
+}
+
+func (o *historyOptions) matches(e *historyEntry, semN *semrelay.Notification) bool {
+	return globMatch(o.project, semN.Project.Name) &&
+		globMatch(o.branch, semN.Revision.Branch.Name) &&
+		(!o.failed || semN.Failed()) &&
+		!e.ReceivedAt.Before(o.since)
+}
+
+// parseSince parses a duration before now, e.g. 24h, or a date or time.
+func parseSince(spec string) (time.Time, error) {
+	if spec == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(spec); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, spec, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q; use a duration like 24h or a date like 2006-01-02", spec)
+}
+
+// runHistory runs the history command: listing entries, or with "show N" or
+// "open N", showing an entry's notification again or opening its workflow.
+func runHistory(args []string) error {
+	if history == nil {
+		return errors.New("history is disabled")
+	}
+	if len(args) == 2 && (args[0] == "show" || args[0] == "open") {
+		seq, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid history entry %s", args[1])
+		}
+		return showHistoryEntry(seq, args[0] == "open")
+	} else if len(args) > 0 {
+		return errors.New("usage: semnotify history [show N | open N]")
+	}
+	since, err := parseSince(viper.GetString("since"))
+	if err != nil {
+		return err
+	}
+	opts := &historyOptions{
+		project: viper.GetString("project"),
+		branch:  viper.GetString("branch"),
+		failed:  viper.GetBool("failed"),
+		since:   since,
+	}
+	entries, err := history.read()
+	if err != nil {
+		return err
+	}
+	return writeHistory(os.Stdout, entries, opts)
+}
+
+func writeHistory(w io.Writer, entries []*historyEntry, opts *historyOptions) error {
+	for _, e := range entries {
+		var semN semrelay.Notification
+		if err := json.Unmarshal(e.Notification, &semN); err != nil {
+			log.WithError(err).WithField("seq", e.Seq).Warn("Skipping invalid notification.")
+			continue
+		}
+		if !opts.matches(e, &semN) {
+			continue
+		}
+		message := strings.SplitN(semN.Revision.CommitMessage, "\n", 2)[0]
+		if _, err := fmt.Fprintf(w, "%5d  %s  %-8s %s:%s  %s %s\n",
+			e.Seq, e.ReceivedAt.Local().Format("2006-01-02 15:04"), semN.Pipeline.Result,
+			semN.Project.Name, semN.Revision.Branch.Name, semN.ShortSHA(),
+			truncate(60, message)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func showHistoryEntry(seq int, open bool) error {
+	entries, err := history.read()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Seq != seq {
+			continue
+		}
+		var semN semrelay.Notification
+		if err := json.Unmarshal(e.Notification, &semN); err != nil {
+			return err
+		}
+		if open {
+			return opener(semN.WorkflowURL())()
+		}
+		// no message ID, since it's no longer on the relay
+		nt, err := newNotice(0, &semN, false)
+		if err != nil {
+			return err
+		}
+		return showOnce(nt)
+	}
+	return fmt.Errorf("no history entry %d", seq)
+}
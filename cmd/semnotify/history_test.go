@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	internal "github.com/csw/semrelay/internal"
+)
+
+func openHistory(t *testing.T, dir string, max int, maxAge time.Duration) *historyStore {
+	h := newHistoryStore(dir, max, maxAge)
+	require.NoError(t, h.open())
+	return h
+}
+
+func historySeqs(t *testing.T, h *historyStore) []int {
+	entries, err := h.read()
+	require.NoError(t, err)
+	var seqs []int
+	for _, e := range entries {
+		seqs = append(seqs, e.Seq)
+	}
+	return seqs
+}
+
+// writeEntries replaces the history file with entries received at the given
+// times.
+func writeEntries(t *testing.T, h *historyStore, receivedAt ...time.Time) {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	for i, at := range receivedAt {
+		require.NoError(t, enc.Encode(&historyEntry{
+			Seq:          i + 1,
+			ReceivedAt:   at,
+			MsgId:        uint64(100 + i),
+			Notification: internal.ExampleSuccess,
+		}))
+	}
+	require.NoError(t, os.WriteFile(h.path, []byte(b.String()), 0o600))
+}
+
+func TestHistorySequence(t *testing.T) {
+	dir := t.TempDir()
+	h := openHistory(t, dir, 100, 0)
+	h.add(10, internal.ExampleSuccess)
+	h.add(11, internal.ExampleFailure)
+	entries, err := h.read()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, 1, entries[0].Seq)
+	assert.Equal(t, uint64(10), entries[0].MsgId)
+	assert.JSONEq(t, string(internal.ExampleFailure), string(entries[1].Notification))
+
+	// numbering carries on after a restart
+	h = openHistory(t, dir, 100, 0)
+	h.add(12, internal.ExampleSuccess)
+	assert.Equal(t, []int{1, 2, 3}, historySeqs(t, h))
+}
+
+func TestHistoryPruneMax(t *testing.T) {
+	h := openHistory(t, t.TempDir(), 10, 0)
+	for i := 0; i < 12; i++ {
+		h.add(uint64(i), internal.ExampleSuccess)
+	}
+	// pruned once it's more than 10% over the limit
+	assert.Equal(t, []int{3, 4, 5, 6, 7, 8, 9, 10, 11, 12}, historySeqs(t, h))
+
+	h = openHistory(t, filepath.Dir(h.path), 5, 0)
+	assert.Equal(t, []int{8, 9, 10, 11, 12}, historySeqs(t, h))
+	h.add(13, internal.ExampleSuccess)
+	assert.Equal(t, []int{9, 10, 11, 12, 13}, historySeqs(t, h))
+}
+
+func TestHistoryPruneAge(t *testing.T) {
+	dir := t.TempDir()
+	h := newHistoryStore(dir, 100, 24*time.Hour)
+	now := time.Now()
+	writeEntries(t, h, now.Add(-72*time.Hour), now.Add(-25*time.Hour), now.Add(-23*time.Hour), now)
+	require.NoError(t, h.open())
+	assert.Equal(t, []int{3, 4}, historySeqs(t, h))
+	h.add(1, internal.ExampleSuccess)
+	assert.Equal(t, []int{3, 4, 5}, historySeqs(t, h))
+
+	// without a maximum age, entries are kept
+	writeEntries(t, h, now.Add(-72*time.Hour), now)
+	h = openHistory(t, dir, 100, 0)
+	assert.Equal(t, []int{1, 2}, historySeqs(t, h))
+}
+
+func TestHistorySkipsTruncatedEntry(t *testing.T) {
+	h := openHistory(t, t.TempDir(), 100, 0)
+	h.add(1, internal.ExampleSuccess)
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"seq": 2, "notifi`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.Equal(t, []int{1}, historySeqs(t, h))
+}
+
+func TestParseSince(t *testing.T) {
+	since, err := parseSince("")
+	require.NoError(t, err)
+	assert.True(t, since.IsZero())
+
+	before := time.Now()
+	since, err = parseSince("90m")
+	require.NoError(t, err)
+	assert.WithinDuration(t, before.Add(-90*time.Minute), since, time.Second)
+
+	for spec, want := range map[string]time.Time{
+		"2024-03-09":                time.Date(2024, 3, 9, 0, 0, 0, 0, time.Local),
+		"2024-03-09 14:30":          time.Date(2024, 3, 9, 14, 30, 0, 0, time.Local),
+		"2024-03-09T14:30:00+02:00": time.Date(2024, 3, 9, 12, 30, 0, 0, time.UTC),
+	} {
+		since, err := parseSince(spec)
+		require.NoError(t, err, spec)
+		assert.True(t, want.Equal(since), "%s: got %s", spec, since)
+	}
+
+	for _, spec := range []string{"yesterday", "2024-13-01", "24", "14:30"} {
+		_, err := parseSince(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestWriteHistory(t *testing.T) {
+	h := openHistory(t, t.TempDir(), 100, 0)
+	h.add(1, internal.ExampleSuccess)
+	h.add(2, internal.ExampleFailure)
+	entries, err := h.read()
+	require.NoError(t, err)
+
+	var b strings.Builder
+	require.NoError(t, writeHistory(&b, entries, &historyOptions{}))
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "passed   myproject:notify_test  e97080e more nothing")
+
+	b.Reset()
+	require.NoError(t, writeHistory(&b, entries, &historyOptions{failed: true}))
+	assert.Contains(t, b.String(), "otherproject")
+	assert.NotContains(t, b.String(), "myproject")
+
+	b.Reset()
+	require.NoError(t, writeHistory(&b, entries, &historyOptions{project: "my*"}))
+	assert.Contains(t, b.String(), "myproject")
+	assert.NotContains(t, b.String(), "otherproject")
+
+	b.Reset()
+	require.NoError(t, writeHistory(&b, entries, &historyOptions{since: time.Now().Add(time.Hour)}))
+	assert.Empty(t, b.String())
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+
+	"github.com/csw/semrelay"
+)
+
+const defaultHookTimeout = 30 * time.Second
+
+// hook is a command to run for notifications matching its patterns. Empty
+// patterns match anything; others are matched with path.Match. The command
+// is run with sh -c, with the notification's fields in environment variables
+// and the Semaphore payload on stdin.
+type hook struct {
+	Command       string        `mapstructure:"command"`
+	Result        string        `mapstructure:"result"`
+	Project       string        `mapstructure:"project"`
+	Branch        string        `mapstructure:"branch"`
+	Timeout       time.Duration `mapstructure:"timeout"`
+	MaxConcurrent int           `mapstructure:"max_concurrent"`
+
+	// slots limits the number of concurrent runs.
+	slots chan struct{}
+}
+
+var hooks []*hook
+
+func loadHooks() error {
+	if err := viper.UnmarshalKey("hooks", &hooks); err != nil {
+		return fmt.Errorf("invalid hooks: %w", err)
+	}
+	for _, h := range hooks {
+		if h.Command == "" {
+			return errors.New("hook has no command")
+		}
+		for _, pattern := range []string{h.Result, h.Project, h.Branch} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid hook pattern %q: %w", pattern, err)
+			}
+		}
+		if h.Timeout == 0 {
+			h.Timeout = defaultHookTimeout
+		}
+		if h.MaxConcurrent <= 0 {
+			h.MaxConcurrent = 1
+		}
+		h.slots = make(chan struct{}, h.MaxConcurrent)
+	}
+	return nil
+}
+
+// runHooks starts the hooks matching the notification in the background, so
+// they don't delay acknowledging it.
+func runHooks(msgId uint64, payload []byte, semN *semrelay.Notification, test bool) {
+	var env []string
+	for _, h := range hooks {
+		if !h.matches(semN) {
+			continue
+		}
+		if env == nil {
+			env = hookEnv(msgId, semN, test)
+		}
+		go h.run(env, payload)
+	}
+}
+
+func (h *hook) matches(semN *semrelay.Notification) bool {
+	return globMatch(h.Result, semN.Pipeline.Result) &&
+		globMatch(h.Project, semN.Project.Name) &&
+		globMatch(h.Branch, semN.Revision.Branch.Name)
+}
+
+func (h *hook) run(env []string, payload []byte) {
+	hlog := log.WithField("hook", h.Command)
+	select {
+	case h.slots <- struct{}{}:
+	default:
+		hlog.Debug("Waiting for earlier runs of hook to finish.")
+		h.slots <- struct{}{}
+	}
+	defer func() { <-h.slots }()
+	var out bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", h.Command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// Run the hook in its own process group, so that on timeout we can kill
+	// any children it started too, which would otherwise keep its output
+	// open.
+	cmd.SysProcAttr = &unix.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		hlog.WithError(err).Error("Starting hook failed.")
+		return
+	}
+	timer := time.AfterFunc(h.Timeout, func() {
+		hlog.WithField("timeout", h.Timeout).Error("Hook timed out.")
+		_ = unix.Kill(-cmd.Process.Pid, unix.SIGKILL)
+	})
+	err := cmd.Wait()
+	if !timer.Stop() {
+		return
+	}
+	if err != nil {
+		hlog.WithError(err).WithField("output", out.String()).Error("Hook failed.")
+	} else {
+		hlog.WithField("output", out.String()).Debug("Hook succeeded.")
+	}
+}
+
+// hookEnv describes the notification in environment variables for hooks.
+func hookEnv(msgId uint64, semN *semrelay.Notification, test bool) []string {
+	vars := map[string]string{
+		"MESSAGE_ID":     strconv.FormatUint(msgId, 10),
+		"RESULT":         semN.Pipeline.Result,
+		"RESULT_REASON":  semN.Pipeline.ResultReason,
+		"ORGANIZATION":   semN.Organization.Name,
+		"PROJECT":        semN.Project.Name,
+		"REPOSITORY":     semN.Repository.Slug,
+		"BRANCH":         semN.Revision.Branch.Name,
+		"REFERENCE_TYPE": semN.Revision.ReferenceType,
+		"COMMIT_SHA":     semN.Revision.CommitSHA,
+		"COMMIT_MESSAGE": semN.Revision.CommitMessage,
+		"SENDER":         semN.Revision.Sender.Login,
+		"PIPELINE_ID":    semN.Pipeline.Id,
+		"YAML_FILE":      semN.Pipeline.YamlFileName,
+		"WORKFLOW_ID":    semN.Workflow.Id,
+		"WORKFLOW_URL":   semN.WorkflowURL(),
+		"PROMOTION":      strconv.FormatBool(semN.IsPromotion()),
+		"TEST":           strconv.FormatBool(test),
+	}
+	if semN.Revision.PullRequest != nil {
+		vars["PR_NUMBER"] = semN.Revision.PullRequest.Number
+	}
+	if duration, err := semN.Duration(); err == nil {
+		vars["DURATION"] = strconv.Itoa(int(duration.Seconds()))
+	}
+	env := make([]string, 0, len(vars))
+	for name, value := range vars {
+		env = append(env, "SEMNOTIFY_"+name+"="+value)
+	}
+	return env
+}
+
+func globMatch(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(pattern, s)
+	return matched
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csw/semrelay"
+	"github.com/csw/semrelay/internal"
+)
+
+// useConfig loads a YAML configuration into viper, resetting it when the
+// test ends.
+func useConfig(t *testing.T, contents string) {
+	t.Cleanup(viper.Reset)
+	viper.SetConfigType("yaml")
+	require.NoError(t, viper.ReadConfig(strings.NewReader(contents)))
+}
+
+func newTestHook(command string, timeout time.Duration, maxConcurrent int) *hook {
+	return &hook{
+		Command:       command,
+		Timeout:       timeout,
+		MaxConcurrent: maxConcurrent,
+		slots:         make(chan struct{}, maxConcurrent),
+	}
+}
+
+func testHookNotification() *semrelay.Notification {
+	var n semrelay.Notification
+	n.Pipeline.Id = "p1"
+	n.Pipeline.Result = "failed"
+	n.Project.Name = "semrelay"
+	n.Repository.Slug = "csw/semrelay"
+	n.Revision.Branch.Name = "main"
+	n.Revision.Sender.Login = "alice"
+	n.Workflow.Id = "w1"
+	n.Workflow.InitialPipelineId = "p1"
+	return &n
+}
+
+func TestHookEnv(t *testing.T) {
+	env := hookEnv(42, testHookNotification(), true)
+	for _, v := range []string{
+		"SEMNOTIFY_MESSAGE_ID=42",
+		"SEMNOTIFY_RESULT=failed",
+		"SEMNOTIFY_PROJECT=semrelay",
+		"SEMNOTIFY_REPOSITORY=csw/semrelay",
+		"SEMNOTIFY_BRANCH=main",
+		"SEMNOTIFY_SENDER=alice",
+		"SEMNOTIFY_PIPELINE_ID=p1",
+		"SEMNOTIFY_WORKFLOW_ID=w1",
+		"SEMNOTIFY_PROMOTION=false",
+		"SEMNOTIFY_TEST=true",
+	} {
+		assert.Contains(t, env, v)
+	}
+	for _, v := range env {
+		assert.False(t, strings.HasPrefix(v, "SEMNOTIFY_PR_NUMBER="), "PR number without a pull request")
+	}
+}
+
+func TestHookRun(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	h := newTestHook(`{ echo "$SEMNOTIFY_RESULT $SEMNOTIFY_BRANCH"; cat; } > `+out, time.Second, 1)
+	h.run(hookEnv(1, testHookNotification(), false), []byte(`{"pipeline":{}}`))
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "failed main\n{\"pipeline\":{}}", string(data))
+}
+
+func TestHookTimeout(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	// the child keeps the hook's output open, so the hook only finishes
+	// early if the whole process group is killed
+	h := newTestHook("sleep 30 & echo $! > "+pidFile+"; wait", 200*time.Millisecond, 1)
+	start := time.Now()
+	h.run(nil, nil)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	data, err := os.ReadFile(pidFile)
+	require.NoError(t, err)
+	pid := strings.TrimSpace(string(data))
+	assert.Eventually(t, func() bool {
+		// a killed child is reaped by init, so its /proc entry goes away
+		// unless it's a zombie
+		stat, err := os.ReadFile("/proc/" + pid + "/stat")
+		return err != nil || strings.Contains(string(stat), ") Z ")
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestHookConcurrency(t *testing.T) {
+	dir := t.TempDir()
+	// mkdir fails if another run holds the lock directory
+	h := newTestHook("mkdir "+filepath.Join(dir, "lock")+" || touch "+filepath.Join(dir, "overlap")+
+		"; sleep 0.1; rmdir "+filepath.Join(dir, "lock"), 5*time.Second, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.run(nil, nil)
+		}()
+	}
+	wg.Wait()
+	assert.NoFileExists(t, filepath.Join(dir, "overlap"))
+
+	h = newTestHook("mkdir "+filepath.Join(dir, "lock")+" || touch "+filepath.Join(dir, "overlap")+
+		"; sleep 0.3; rmdir "+filepath.Join(dir, "lock"), 5*time.Second, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.run(nil, nil)
+		}()
+	}
+	wg.Wait()
+	assert.FileExists(t, filepath.Join(dir, "overlap"), "runs up to the limit overlap")
+}
+
+func TestLoadHooksDefaults(t *testing.T) {
+	defer func() { hooks = nil }()
+	useConfig(t, "hooks:\n  - command: 'true'\n    result: failed\n")
+	require.NoError(t, loadHooks())
+	require.Len(t, hooks, 1)
+	assert.Equal(t, defaultHookTimeout, hooks[0].Timeout)
+	assert.Equal(t, 1, hooks[0].MaxConcurrent)
+	assert.True(t, hooks[0].matches(testHookNotification()))
+	n := testHookNotification()
+	n.Pipeline.Result = "passed"
+	assert.False(t, hooks[0].matches(n))
+
+	useConfig(t, "hooks:\n  - command: 'true'\n    branch: '['\n")
+	assert.Error(t, loadHooks())
+}
+
+func TestHooksSkipHeldNotifications(t *testing.T) {
+	useStatusFile(t)
+	f := useBackend(t)
+	dir := t.TempDir()
+	var err error
+	oldSeen := seen
+	seen, err = loadSeen(filepath.Join(dir, "seen.json"))
+	require.NoError(t, err)
+	out := filepath.Join(dir, "out")
+	hooks = []*hook{newTestHook(`echo "$SEMNOTIFY_MESSAGE_ID" >> `+out, time.Second, 1)}
+	defer func() {
+		seen = oldSeen
+		hooks = nil
+		quiet = nil
+	}()
+	message := func(id uint64, pipelineId string) *semrelay.Message {
+		n := parseExample(t, internal.ExampleFailure)
+		n.Pipeline.Id = pipelineId
+		n.Workflow.InitialPipelineId = pipelineId
+		payload, err := json.Marshal(n)
+		require.NoError(t, err)
+		return &semrelay.Message{Type: semrelay.NotificationMsg, Id: id, Payload: payload}
+	}
+
+	quiet = allDay(t, filepath.Join(dir, "held.json"))
+	require.NoError(t, handleMessage(context.Background(), message(1, "p1")))
+	quiet = nil
+	require.NoError(t, handleMessage(context.Background(), message(2, "p2")))
+	require.Len(t, f.shown(), 1)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(out)
+		return err == nil
+	}, 2*time.Second, 5*time.Millisecond)
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "2\n", string(data), "only the shown notification runs hooks")
+}
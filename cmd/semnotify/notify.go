@@ -1,173 +1,156 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"os/exec"
-	"strings"
+	"time"
 
-	"github.com/csw/semrelay"
-	"github.com/esiqveland/notify"
-	dbus "github.com/godbus/dbus/v5"
 	log "github.com/sirupsen/logrus"
-)
 
-const dbusName = "semrelay.Semnotify"
-
-var dConn *dbus.Conn
-var notifier notify.Notifier
+	"github.com/csw/semrelay"
+)
 
-type registration struct {
-	id  uint32
-	url string
+// Notifier is a backend that shows notifications to the user.
+type Notifier interface {
+	// Notify shows a notification.
+	Notify(nt *notice) error
+	// Dismiss hides the notification for the given relay message ID, which
+	// was dismissed on another device, if the backend supports it.
+	Dismiss(msgId uint64)
+	// Close releases the backend's resources.
+	Close() error
 }
 
-// registry associates DBus notification IDs with the corresponding URLs for the
-// Semaphore pipeline pages, to display when the user clicks on a notification.
-var registry = make(map[uint32]string)
-
-var registerCh = make(chan registration, 8)
-var clickCh = make(chan uint32, 8)
+// backend is the configured Notifier.
+var backend Notifier
+
+// notice is a build notification prepared for display.
+type notice struct {
+	MsgId   uint64 `json:"id,string"`
+	Summary string `json:"summary"`
+	Body    string `json:"body"`
+	URL     string `json:"url"`
+	Failed  bool   `json:"failed"`
+	Test    bool   `json:"test,omitempty"`
+	// Tag identifies the project and branch, so that newer notifications
+	// can replace older ones rather than being displayed alongside them.
+	Tag          string                 `json:"tag"`
+	Notification *semrelay.Notification `json:"notification"`
+}
 
-var icon *DBusIcon
+// newNotifier creates the named backend.
+func newNotifier(name string) (Notifier, error) {
+	switch name {
+	case "", "dbus":
+		return newDBusNotifier()
+	case "stdout":
+		return newStdoutNotifier(), nil
+	case "notify-send":
+		return newNotifySendNotifier()
+	case "file":
+		return newFileNotifier(dropDir)
+	default:
+		return nil, fmt.Errorf("unknown notifier %s", name)
+	}
+}
 
-func notifyUser(semN *semrelay.Notification) error {
-	if !promotions && semN.Pipeline.Id != semN.Workflow.InitialPipelineId {
+// wanted reports whether the user wants to know about the notification,
+// according to the promotions setting and the filters.
+func wanted(semN *semrelay.Notification, test bool) bool {
+	if !promotions && semN.IsPromotion() {
 		// Only display results for the original pipeline. This avoids
 		// displaying notifications for automatic promotions that might validly
 		// fail.
 		log.Debugf("Ignoring result for pipeline %s.", semN.Pipeline.YamlFileName)
-		return nil
+		return false
+	}
+	if !test && !included(semN) {
+		log.Debugf("Filtered out result for %s:%s.", semN.Project.Name, semN.Revision.Branch.Name)
+		return false
 	}
-	log.WithFields(log.Fields{
+	return true
+}
+
+// notifyUser shows a wanted notification, unless it's held for quiet hours or
+// notifications are paused, and reports whether it was shown.
+func notifyUser(msgId uint64, semN *semrelay.Notification, test bool) (bool, error) {
+	nt, err := newNotice(msgId, semN, test)
+	if err != nil {
+		return false, err
+	}
+	fields := log.Fields{
 		"user":       user,
 		"repository": semN.Repository.Slug,
 		"done_at":    semN.Pipeline.DoneAt,
 		"pipeline":   semN.Pipeline.Id,
-	}).Info("Showing notification")
-	urgency := dbus.MakeVariant(1) // Normal
-	if semN.Pipeline.Result == "failed" {
-		urgency = dbus.MakeVariant(byte(2)) // Critical
-	}
-	url := fmt.Sprintf("https://%s.semaphoreci.com/workflows/%s?pipeline_id=%s",
-		semN.Organization.Name, semN.Workflow.Id, semN.Pipeline.Id)
-	// The stacking tag is for x-dunst-stack-tag, so that newer notifications
-	// for a given branch will be displayed instead of older ones, rather than
-	// alongside them.
-	tag := fmt.Sprintf("%s/%s", semN.Project.Name, semN.Revision.Branch.Name)
-	titleText, err := title(semN)
-	if err != nil {
-		return err
 	}
-	n := notify.Notification{
-		AppName:    "Semaphore",
-		ReplacesID: uint32(0),
-		Summary:    titleText,
-		Body:       body(semN),
-		Actions: []notify.Action{
-			{Key: "default", Label: "Open"},
-		},
-		Hints: map[string]dbus.Variant{
-			"urgency":           urgency,
-			"x-dunst-stack-tag": dbus.MakeVariant(tag),
-			"image-data":        dbus.MakeVariant(icon),
-		},
-		ExpireTimeout: ttl,
+	if !test {
+		bs := newBuildState(nt)
+		recordStatus(nt.Tag, bs)
+		if trayIcon != nil {
+			trayIcon.add(bs)
+		}
 	}
-	id, err := notifier.SendNotification(n)
-	if err != nil {
-		return err
+	if notificationsPaused() {
+		log.WithFields(fields).Info("Not showing notification while paused")
+		return false, nil
 	}
-	// Register the URL to be displayed when the action is invoked.
-	registerCh <- registration{id: id, url: url}
-	return nil
-}
-
-func onAction(action *notify.ActionInvokedSignal) {
-	clickCh <- action.ID
-}
-
-func runHandler() {
-	for {
-		select {
-		case reg := <-registerCh:
-			registry[reg.id] = reg.url
-		case id := <-clickCh:
-			url, found := registry[id]
-			if !found {
-				continue
-			}
-			delete(registry, id)
-			log.WithField("url", url).Debug("Opening URL on click.")
-			cmd := exec.Command("xdg-open", url)
-			err := cmd.Run()
-			if err != nil {
-				log.WithField("url", url).WithError(err).Error("Error opening URL.")
-			}
-		}
+	if !test && quiet != nil && quiet.hold(nt) {
+		log.WithFields(fields).Info("Holding notification for quiet hours")
+		return false, nil
 	}
+	log.WithFields(fields).Info("Showing notification")
+	return true, backend.Notify(nt)
 }
 
-func initDBus() error {
-	var err error
-	dConn, err = dbus.SessionBusPrivate()
+// newNotice formats a notification for display.
+func newNotice(msgId uint64, semN *semrelay.Notification, test bool) (*notice, error) {
+	titleText, err := title(semN)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	if err = dConn.Auth(nil); err != nil {
-		dConn.Close()
-		return err
+	if test {
+		titleText = "[Test] " + titleText
 	}
-
-	if err = dConn.Hello(); err != nil {
-		dConn.Close()
-		return err
-	}
-
-	reply, err := dConn.RequestName(dbusName, dbus.NameFlagDoNotQueue)
+	bodyText, err := body(semN)
 	if err != nil {
-		return err
-	}
-	if reply == dbus.RequestNameReplyExists {
-		return errors.New("semnotify already running and registered with DBus")
-	} else if reply != dbus.RequestNameReplyPrimaryOwner {
-		return fmt.Errorf("failed to acquire DBus name: RequestNameReply %d", reply)
-	}
+		return nil, err
+	}
+	return &notice{
+		MsgId:        msgId,
+		Summary:      titleText,
+		Body:         bodyText,
+		URL:          semN.WorkflowURL(),
+		Failed:       semN.Failed(),
+		Test:         test,
+		Tag:          fmt.Sprintf("%s/%s", semN.Project.Name, semN.Revision.Branch.Name),
+		Notification: semN,
+	}, nil
+}
 
-	notifier, err = notify.New(dConn, notify.WithOnAction(onAction))
-	if err != nil {
-		dConn.Close()
+// showOnce shows a single notice, outside of the relay connection, and waits
+// a while for clicks if the backend supports them.
+func showOnce(nt *notice) error {
+	var err error
+	if backend, err = newNotifier(notifierName); err != nil {
 		return err
 	}
-	server, err := notifier.GetServerInformation()
-	if err != nil {
-		dConn.Close()
-		return err
+	err = backend.Notify(nt)
+	if _, isDBus := backend.(*dbusNotifier); err == nil && isDBus {
+		// stay around to handle clicks
+		time.Sleep(5 * time.Second)
 	}
-	log.Debugf("Notification daemon: %s (%s), version %s, specification version %s\n",
-		server.Name, server.Vendor, server.Version, server.SpecVersion)
-	caps, err := notifier.GetCapabilities()
-	if err != nil {
-		dConn.Close()
-		return err
+	if cerr := backend.Close(); cerr != nil {
+		return cerr
 	}
-	log.Debugf("Notification daemon capabilities: %s\n", strings.Join(caps, ", "))
-
-	icon = buildIcon(semrelay.IconImage)
-
-	go runHandler()
-
-	return nil
+	return err
 }
 
-func cleanupDBus() error {
-	if err := notifier.Close(); err != nil {
-		log.WithError(err).Error("Error closing notifier.")
-	}
-	if err := dConn.Close(); err != nil {
-		log.WithError(err).Error("Error closing DBus connection.")
-		return err
+// sendDismiss tells the server that the user clicked or dismissed the
+// notification for the given relay message ID, to relay to other devices.
+func sendDismiss(msgId uint64) {
+	if msgId == 0 || relayClient == nil {
+		// examples aren't from the relay
+		return
 	}
-	return nil
+	relayClient.Dismiss(msgId)
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/csw/semrelay"
+)
+
+// semaphoreAPI calls the Semaphore API to rerun workflows.
+type semaphoreAPI struct {
+	// baseURL replaces the organization's https://ORG.semaphoreci.com URL if
+	// set, e.g. for testing.
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// api is set if an API token is configured.
+var api *semaphoreAPI
+
+func newSemaphoreAPI(baseURL, token string) *semaphoreAPI {
+	return &semaphoreAPI{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (a *semaphoreAPI) url(semN *semrelay.Notification, path string) string {
+	base := a.baseURL
+	if base == "" {
+		base = fmt.Sprintf("https://%s.semaphoreci.com", semN.Organization.Name)
+	}
+	return base + "/api/v1alpha/" + path
+}
+
+func (a *semaphoreAPI) do(method, url string, reqBody interface{}, resBody interface{}) error {
+	var body io.Reader
+	if reqBody != nil {
+		enc, err := json.Marshal(reqBody)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(enc)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+a.token)
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	if resBody == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(resBody)
+}
+
+// Rerun reschedules the workflow, returning the new workflow and pipeline
+// IDs.
+func (a *semaphoreAPI) Rerun(semN *semrelay.Notification) (wfId, pplId string, err error) {
+	token, err := requestToken()
+	if err != nil {
+		return "", "", err
+	}
+	var res struct {
+		WfId  string `json:"wf_id"`
+		PplId string `json:"ppl_id"`
+	}
+	path := fmt.Sprintf("plumber-workflows/%s/reschedule?request_token=%s",
+		url.PathEscape(semN.Workflow.Id), token)
+	if err := a.do(http.MethodPost, a.url(semN, path), nil, &res); err != nil {
+		return "", "", err
+	}
+	return res.WfId, res.PplId, nil
+}
+
+// requestToken returns a random UUID, which Semaphore uses to make reruns
+// idempotent.
+func requestToken() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// pipelineDone is the state of a finished pipeline.
+const pipelineDone = "done"
+
+// apiActions returns the actions using the Semaphore API: rerunning finished
+// builds that didn't pass. Semaphore only sends webhooks for finished
+// pipelines, so there's nothing running to stop.
+func apiActions(nt *notice) []action {
+	semN := nt.Notification
+	if api == nil || semN == nil || nt.Test ||
+		semN.Pipeline.State != pipelineDone || semN.Pipeline.Result == semrelay.ResultPassed {
+		return nil
+	}
+	return []action{{key: "rerun", label: "Rerun", run: func() error {
+		return rerunWorkflow(nt)
+	}}}
+}
+
+func rerunWorkflow(nt *notice) error {
+	semN := nt.Notification
+	name := fmt.Sprintf("%s:%s", semN.Project.Name, semN.Revision.Branch.Name)
+	wfId, pplId, err := api.Rerun(semN)
+	if err != nil {
+		showOutcome(nt, "Rerun failed for "+name, err.Error(), nt.URL, true)
+		return err
+	}
+	rerun := *semN
+	rerun.Workflow.Id = wfId
+	rerun.Pipeline.Id = pplId
+	showOutcome(nt, "Rerunning "+name, fmt.Sprintf("Commit %s: %s\n",
+		semN.ShortSHA(), semN.Revision.CommitMessage), rerun.WorkflowURL(), false)
+	return nil
+}
+
+// showOutcome shows a follow-up notification for an API action, replacing
+// the original notification.
+func showOutcome(nt *notice, summary, body, url string, failed bool) {
+	log.WithField("summary", summary).Info("Showing action outcome")
+	err := backend.Notify(&notice{
+		Summary: summary,
+		Body:    body,
+		URL:     url,
+		Failed:  failed,
+		Tag:     nt.Tag,
+	})
+	if err != nil {
+		log.WithError(err).Error("Error showing action outcome.")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csw/semrelay"
+	internal "github.com/csw/semrelay/internal"
+)
+
+// fakeSemaphore is a Semaphore API server that records the requests it
+// gets.
+type fakeSemaphore struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newFakeSemaphore(t *testing.T) *fakeSemaphore {
+	f := &fakeSemaphore{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.requests = append(f.requests, r)
+		f.mu.Unlock()
+		if r.Header.Get("Authorization") != "Token secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"wf_id": "new-wf", "ppl_id": "new-ppl"}`))
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeSemaphore) lastRequest(t *testing.T) *http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	require.NotEmpty(t, f.requests)
+	return f.requests[len(f.requests)-1]
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestSemaphoreAPIRerun(t *testing.T) {
+	srv := newFakeSemaphore(t)
+	semN := parseExample(t, internal.ExampleFailure)
+	a := newSemaphoreAPI(srv.URL+"/", "secret")
+
+	wfId, pplId, err := a.Rerun(semN)
+	require.NoError(t, err)
+	assert.Equal(t, "new-wf", wfId)
+	assert.Equal(t, "new-ppl", pplId)
+	r := srv.lastRequest(t)
+	assert.Equal(t, http.MethodPost, r.Method)
+	assert.Equal(t, "/api/v1alpha/plumber-workflows/"+semN.Workflow.Id+"/reschedule", r.URL.Path)
+	assert.Equal(t, "Token secret", r.Header.Get("Authorization"))
+	token := r.URL.Query().Get("request_token")
+	assert.Regexp(t, uuidPattern, token)
+
+	// each rerun is a new request
+	_, _, err = a.Rerun(semN)
+	require.NoError(t, err)
+	assert.NotEqual(t, token, srv.lastRequest(t).URL.Query().Get("request_token"))
+}
+
+func TestSemaphoreAPIError(t *testing.T) {
+	srv := newFakeSemaphore(t)
+	_, _, err := newSemaphoreAPI(srv.URL, "wrong").Rerun(parseExample(t, internal.ExampleFailure))
+	assert.EqualError(t, err, "401 Unauthorized: unauthorized")
+}
+
+func TestAPIActions(t *testing.T) {
+	srv := newFakeSemaphore(t)
+	api = newSemaphoreAPI(srv.URL, "secret")
+	defer func() { api = nil }()
+
+	keys := func(nt *notice) []string {
+		var keys []string
+		for _, a := range apiActions(nt) {
+			keys = append(keys, a.key)
+		}
+		return keys
+	}
+	withResult := func(state, result string) *notice {
+		semN := parseExample(t, internal.ExampleFailure)
+		semN.Pipeline.State = state
+		semN.Pipeline.Result = result
+		return &notice{Notification: semN}
+	}
+	assert.Equal(t, []string{"rerun"}, keys(withResult("done", semrelay.ResultFailed)))
+	assert.Equal(t, []string{"rerun"}, keys(withResult("done", semrelay.ResultStopped)))
+	assert.Equal(t, []string{"rerun"}, keys(withResult("done", semrelay.ResultCanceled)))
+	assert.Empty(t, keys(withResult("done", semrelay.ResultPassed)))
+	assert.Empty(t, keys(withResult("running", "")))
+	assert.Empty(t, keys(withResult("", "")))
+	test := withResult("done", semrelay.ResultFailed)
+	test.Test = true
+	assert.Empty(t, keys(test))
+
+	f := useBackend(t)
+	nt := withResult("done", semrelay.ResultFailed)
+	nt.Tag = "tag"
+	require.NoError(t, apiActions(nt)[0].run())
+	shown := f.shown()
+	require.Len(t, shown, 1)
+	assert.Equal(t, "Rerunning otherproject:notify_test", shown[0].Summary)
+	assert.Equal(t, "tag", shown[0].Tag)
+	assert.Contains(t, shown[0].URL, "new-wf")
+}
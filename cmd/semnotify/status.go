@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/csw/semrelay"
+)
+
+// buildState is the latest result for a project and branch.
+type buildState struct {
+	Project    string   `json:"project"`
+	Branch     string   `json:"branch"`
+	Result     string   `json:"result"`
+	Summary    string   `json:"summary"`
+	URL        string   `json:"url"`
+	DoneAt     string   `json:"done_at"`
+	FailedJobs []string `json:"failed_jobs,omitempty"`
+}
+
+// statusState is the contents of the status file, which the running client
+// updates for status bars to read with semnotify status.
+type statusState struct {
+	// Builds is keyed by notice tag.
+	Builds map[string]*buildState `json:"builds"`
+	// Connection is the state of the connection to the relay.
+	Connection *connectionState `json:"connection,omitempty"`
+}
+
+// statusFile is the path of the status file.
+var statusFile string
+
+var statusMu sync.Mutex
+
+func newBuildState(nt *notice) *buildState {
+	semN := nt.Notification
+	bs := &buildState{
+		Project: semN.Project.Name,
+		Branch:  semN.Revision.Branch.Name,
+		Result:  semN.Pipeline.Result,
+		Summary: nt.Summary,
+		URL:     nt.URL,
+		DoneAt:  semN.Pipeline.DoneAt,
+	}
+	for _, job := range semN.FailedJobs() {
+		bs.FailedJobs = append(bs.FailedJobs, job.Name)
+	}
+	return bs
+}
+
+// recordStatus saves the build as the latest for the tag's project and
+// branch.
+func recordStatus(tag string, bs *buildState) {
+	updateStatus(func(state *statusState) {
+		if state.Builds == nil {
+			state.Builds = make(map[string]*buildState)
+		}
+		state.Builds[tag] = bs
+	})
+}
+
+// updateStatus applies an update to the status file.
+func updateStatus(update func(state *statusState)) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	state, err := readStatus()
+	if err != nil {
+		log.WithError(err).Error("Error reading status file.")
+		state = &statusState{}
+	}
+	update(state)
+	enc, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(statusFile), 0o700); err != nil {
+		log.WithError(err).Error("Error creating status directory.")
+		return
+	}
+	if err := writeFileAtomic(statusFile, append(enc, '\n')); err != nil {
+		log.WithError(err).Error("Error writing status file.")
+	}
+}
+
+func readStatus() (*statusState, error) {
+	var state statusState
+	raw, err := os.ReadFile(statusFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return &state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, fmt.Errorf("invalid status file %s: %w", statusFile, err)
+	}
+	return &state, nil
+}
+
+// statusOptions select the builds to summarize and how to show them.
+type statusOptions struct {
+	format  string
+	project string
+	branch  string
+}
+
+// summary is the status bar entry for the selected builds.
+type summary struct {
+	Text    string
+	Tooltip string
+	// Class is the overall result: failed if any build failed, passed if
+	// they all passed, or else the latest build's result, or none.
+	Class string
+	// URL is the latest failed build's workflow, or else the latest build's.
+	URL string
+	// Disconnected is set when semnotify isn't connected to the relay.
+	Disconnected bool
+}
+
+// sortedBuilds returns the selected builds, latest first.
+func (o *statusOptions) sortedBuilds(state *statusState) []*buildState {
+	var builds []*buildState
+	for _, bs := range state.Builds {
+		if globMatch(o.project, bs.Project) && globMatch(o.branch, bs.Branch) {
+			builds = append(builds, bs)
+		}
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].DoneAt > builds[j].DoneAt
+	})
+	return builds
+}
+
+func (o *statusOptions) summarize(state *statusState) summary {
+	s := o.summarizeBuilds(state)
+	if cs := state.Connection; cs != nil && cs.State != connConnected {
+		s.Disconnected = true
+		s.Text = "⚠ " + s.Text
+		s.Tooltip = cs.describe() + "\n" + s.Tooltip
+	}
+	return s
+}
+
+func (o *statusOptions) summarizeBuilds(state *statusState) summary {
+	builds := o.sortedBuilds(state)
+	if len(builds) == 0 {
+		return summary{Text: "-", Tooltip: "No builds yet", Class: "none"}
+	}
+	var failed []*buildState
+	passed := 0
+	for _, bs := range builds {
+		switch bs.Result {
+		case semrelay.ResultFailed:
+			failed = append(failed, bs)
+		case semrelay.ResultPassed:
+			passed++
+		}
+	}
+	if len(failed) > 0 {
+		var lines []string
+		for _, bs := range failed {
+			line := fmt.Sprintf("%s:%s failed", bs.Project, bs.Branch)
+			if len(bs.FailedJobs) > 0 {
+				line += " in " + strings.Join(bs.FailedJobs, ", ")
+			}
+			lines = append(lines, line)
+		}
+		return summary{
+			Text:    fmt.Sprintf("✘ %d/%d", len(failed), len(builds)),
+			Tooltip: strings.Join(lines, "\n"),
+			Class:   semrelay.ResultFailed,
+			URL:     failed[0].URL,
+		}
+	}
+	class := builds[0].Result
+	if passed == len(builds) {
+		class = semrelay.ResultPassed
+	}
+	return summary{
+		Text:    fmt.Sprintf("✔ %d", passed),
+		Tooltip: builds[0].Summary,
+		Class:   class,
+		URL:     builds[0].URL,
+	}
+}
+
+// i3blocksColors are the colors for each class in i3blocks output.
+var i3blocksColors = map[string]string{
+	semrelay.ResultPassed:   "#50fa7b",
+	semrelay.ResultFailed:   "#ff5555",
+	semrelay.ResultStopped:  "#f1fa8c",
+	semrelay.ResultCanceled: "#f1fa8c",
+}
+
+func (o *statusOptions) write(w io.Writer, state *statusState) error {
+	switch o.format {
+	case "waybar":
+		s := o.summarize(state)
+		classes := []string{s.Class}
+		if s.Disconnected {
+			classes = append(classes, "disconnected")
+		}
+		return json.NewEncoder(w).Encode(map[string]interface{}{
+			"text":    s.Text,
+			"tooltip": s.Tooltip,
+			"class":   classes,
+			"alt":     s.Class,
+		})
+	case "i3blocks":
+		s := o.summarize(state)
+		out := map[string]string{"full_text": s.Text, "short_text": s.Text}
+		if color, found := i3blocksColors[s.Class]; found {
+			out["color"] = color
+		}
+		return json.NewEncoder(w).Encode(out)
+	case "text":
+		if cs := state.Connection; cs != nil {
+			if _, err := fmt.Fprintln(w, cs.describe()); err != nil {
+				return err
+			}
+		}
+		for _, bs := range o.sortedBuilds(state) {
+			if _, err := fmt.Fprintf(w, "%-8s %s:%s\t%s\t%s\n",
+				bs.Result, bs.Project, bs.Branch, bs.DoneAt, bs.URL); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown status format %s", o.format)
+	}
+}
+
+// runStatus runs the status command.
+func runStatus() error {
+	statusFile = viper.GetString("status_file")
+	opts := &statusOptions{
+		format:  viper.GetString("format"),
+		project: viper.GetString("project"),
+		branch:  viper.GetString("branch"),
+	}
+	return showStatus(opts, viper.GetBool("follow"), viper.GetBool("open"))
+}
+
+// showStatus writes the status, and with follow, writes it again whenever the
+// status file changes, for status bars that read a stream. With open, it
+// opens the latest relevant workflow instead, for clicks on the status bar.
+func showStatus(opts *statusOptions, follow, open bool) error {
+	if open {
+		state, err := readStatus()
+		if err != nil {
+			return err
+		}
+		url := opts.summarize(state).URL
+		if url == "" {
+			return errors.New("no builds yet")
+		}
+		return opener(url)()
+	}
+	var lastMod time.Time
+	for written := false; ; written = true {
+		var modTime time.Time
+		if info, err := os.Stat(statusFile); err == nil {
+			modTime = info.ModTime()
+		}
+		if !written || !modTime.Equal(lastMod) {
+			lastMod = modTime
+			state, err := readStatus()
+			if err != nil {
+				return err
+			}
+			if err := opts.write(os.Stdout, state); err != nil {
+				return err
+			}
+		}
+		if !follow {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+}
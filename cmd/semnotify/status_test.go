@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csw/semrelay"
+)
+
+func testBuild(project, branch, result, doneAt string, failedJobs ...string) *buildState {
+	return &buildState{
+		Project:    project,
+		Branch:     branch,
+		Result:     result,
+		Summary:    "Build " + result + " for " + project + ":" + branch,
+		URL:        "https://semaphore.example.com/" + project + "/" + branch,
+		DoneAt:     doneAt,
+		FailedJobs: failedJobs,
+	}
+}
+
+func testStatus() *statusState {
+	return &statusState{Builds: map[string]*buildState{
+		"api/main":    testBuild("api", "main", semrelay.ResultPassed, "2024-03-09T10:00:00Z"),
+		"api/feature": testBuild("api", "feature", semrelay.ResultFailed, "2024-03-09T09:00:00Z", "test"),
+		"web/main":    testBuild("web", "main", semrelay.ResultPassed, "2024-03-09T12:00:00Z"),
+		"web/fix":     testBuild("web", "fix", semrelay.ResultFailed, "2024-03-09T11:00:00Z", "lint", "build"),
+		"docs/main":   testBuild("docs", "main", semrelay.ResultStopped, "2024-03-09T08:00:00Z"),
+	}}
+}
+
+func TestSummarize(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		opts  statusOptions
+		state *statusState
+		want  summary
+	}{
+		{
+			name:  "no builds",
+			state: &statusState{},
+			want:  summary{Text: "-", Tooltip: "No builds yet", Class: "none"},
+		},
+		{
+			name:  "failed builds first, latest first",
+			state: testStatus(),
+			want: summary{
+				Text:    "✘ 2/5",
+				Tooltip: "web:fix failed in lint, build\napi:feature failed in test",
+				Class:   semrelay.ResultFailed,
+				URL:     "https://semaphore.example.com/web/fix",
+			},
+		},
+		{
+			name:  "project glob",
+			opts:  statusOptions{project: "a*"},
+			state: testStatus(),
+			want: summary{
+				Text:    "✘ 1/2",
+				Tooltip: "api:feature failed in test",
+				Class:   semrelay.ResultFailed,
+				URL:     "https://semaphore.example.com/api/feature",
+			},
+		},
+		{
+			name:  "branch glob",
+			opts:  statusOptions{branch: "ma*"},
+			state: testStatus(),
+			want: summary{
+				Text:    "✔ 2",
+				Tooltip: "Build passed for web:main",
+				Class:   semrelay.ResultPassed,
+				URL:     "https://semaphore.example.com/web/main",
+			},
+		},
+		{
+			name:  "latest result",
+			opts:  statusOptions{project: "docs"},
+			state: testStatus(),
+			want: summary{
+				Text:    "✔ 0",
+				Tooltip: "Build stopped for docs:main",
+				Class:   semrelay.ResultStopped,
+				URL:     "https://semaphore.example.com/docs/main",
+			},
+		},
+		{
+			name:  "all passed",
+			opts:  statusOptions{project: "web", branch: "main"},
+			state: testStatus(),
+			want: summary{
+				Text:    "✔ 1",
+				Tooltip: "Build passed for web:main",
+				Class:   semrelay.ResultPassed,
+				URL:     "https://semaphore.example.com/web/main",
+			},
+		},
+		{
+			name:  "no match",
+			opts:  statusOptions{project: "mobile"},
+			state: testStatus(),
+			want:  summary{Text: "-", Tooltip: "No builds yet", Class: "none"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.opts.summarize(tc.state))
+		})
+	}
+}
+
+func TestSummarizeDisconnected(t *testing.T) {
+	opts := statusOptions{project: "web", branch: "main"}
+	state := testStatus()
+	state.Connection = &connectionState{State: connConnected, Server: "relay.example.com", Since: time.Now()}
+	s := opts.summarize(state)
+	assert.False(t, s.Disconnected)
+	assert.Equal(t, "✔ 1", s.Text)
+
+	state.Connection = &connectionState{
+		State:     connDisconnected,
+		Server:    "relay.example.com",
+		Since:     time.Now(),
+		LastError: "connection refused",
+		Attempts:  3,
+	}
+	s = opts.summarize(state)
+	assert.True(t, s.Disconnected)
+	assert.Equal(t, "⚠ ✔ 1", s.Text)
+	assert.Equal(t, semrelay.ResultPassed, s.Class)
+	assert.True(t, strings.HasPrefix(s.Tooltip, "Disconnected from relay.example.com since "))
+	assert.True(t, strings.HasSuffix(s.Tooltip, "\nBuild passed for web:main"))
+
+	state.Connection.State = connStopped
+	assert.True(t, strings.HasPrefix(opts.summarize(state).Tooltip, "semnotify stopped at "))
+}
+
+func writeStatus(t *testing.T, opts statusOptions, state *statusState) map[string]interface{} {
+	var b strings.Builder
+	require.NoError(t, opts.write(&b, state))
+	var out map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(b.String()), &out))
+	return out
+}
+
+func TestWriteStatus(t *testing.T) {
+	state := testStatus()
+	assert.Equal(t, map[string]interface{}{
+		"text":    "✘ 2/5",
+		"tooltip": "web:fix failed in lint, build\napi:feature failed in test",
+		"class":   []interface{}{"failed"},
+		"alt":     "failed",
+	}, writeStatus(t, statusOptions{format: "waybar"}, state))
+	assert.Equal(t, map[string]interface{}{
+		"full_text":  "✔ 1",
+		"short_text": "✔ 1",
+		"color":      "#50fa7b",
+	}, writeStatus(t, statusOptions{format: "i3blocks", project: "web", branch: "main"}, state))
+	// no color without a result
+	assert.Equal(t, map[string]interface{}{
+		"full_text":  "-",
+		"short_text": "-",
+	}, writeStatus(t, statusOptions{format: "i3blocks"}, &statusState{}))
+
+	state.Connection = &connectionState{State: connDisconnected, Server: "relay.example.com", Since: time.Now()}
+	waybar := writeStatus(t, statusOptions{format: "waybar"}, state)
+	assert.Equal(t, []interface{}{"failed", "disconnected"}, waybar["class"])
+	assert.Equal(t, "⚠ ✘ 2/5", waybar["text"])
+
+	var b strings.Builder
+	require.NoError(t, (&statusOptions{format: "text", branch: "main"}).write(&b, state))
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	require.Len(t, lines, 4)
+	assert.True(t, strings.HasPrefix(lines[0], "Disconnected from relay.example.com"))
+	assert.Equal(t, "passed   web:main\t2024-03-09T12:00:00Z\thttps://semaphore.example.com/web/main", lines[1])
+	assert.True(t, strings.HasPrefix(lines[3], "stopped  docs:main"))
+
+	assert.EqualError(t, (&statusOptions{format: "polybar"}).write(&b, state), "unknown status format polybar")
+}
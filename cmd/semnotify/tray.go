@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"sync"
+	"sync/atomic"
+
+	dbus "github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/csw/semrelay"
+)
+
+// The tray icon implements the StatusNotifierItem and dbusmenu specs, on the
+// same DBus connection as the notifications.
+const (
+	sniPath   = dbus.ObjectPath("/StatusNotifierItem")
+	sniIface  = "org.kde.StatusNotifierItem"
+	menuPath  = dbus.ObjectPath("/MenuBar")
+	menuIface = "com.canonical.dbusmenu"
+)
+
+// Menu item IDs after the recent builds, which start at 1.
+const (
+	menuSeparator int32 = iota + 1000
+	menuPause
+	menuReconnect
+)
+
+// paused is set while notifications are paused from the tray menu.
+var paused int32
+
+func notificationsPaused() bool {
+	return atomic.LoadInt32(&paused) != 0
+}
+
+type sniPixmap struct {
+	Width  int32
+	Height int32
+	// Data is ARGB32 in network byte order.
+	Data []byte
+}
+
+type sniToolTip struct {
+	IconName    string
+	IconPixmap  []sniPixmap
+	Title       string
+	Description string
+}
+
+type menuLayout struct {
+	Id         int32
+	Properties map[string]dbus.Variant
+	Children   []dbus.Variant
+}
+
+type menuItemProperties struct {
+	Id         int32
+	Properties map[string]dbus.Variant
+}
+
+type menuEvent struct {
+	Id        int32
+	EventId   string
+	Data      dbus.Variant
+	Timestamp uint32
+}
+
+type menuItem struct {
+	id    int32
+	props map[string]dbus.Variant
+	// run is called when the item is clicked.
+	run func()
+}
+
+// tray is the tray icon, showing the latest result, with a menu of recent
+// builds.
+type tray struct {
+	props *prop.Properties
+	max   int
+
+	mu       sync.Mutex
+	recent   []*buildState
+	items    []menuItem
+	revision uint32
+}
+
+// trayIcon is set if the tray icon is enabled.
+var trayIcon *tray
+
+// resultColors tint the icon for each result.
+var resultColors = map[string][3]uint8{
+	semrelay.ResultPassed:   {0x2e, 0xc2, 0x7e},
+	semrelay.ResultFailed:   {0xe0, 0x1b, 0x24},
+	semrelay.ResultStopped:  {0xf5, 0xc2, 0x11},
+	semrelay.ResultCanceled: {0xf5, 0xc2, 0x11},
+}
+
+var resultSymbols = map[string]string{
+	semrelay.ResultPassed: "✔",
+	semrelay.ResultFailed: "✘",
+}
+
+// startTray exports the tray icon and registers it with the
+// StatusNotifierWatcher, showing up to max recent builds.
+func startTray(max int) error {
+	t := &tray{max: max}
+	state, err := readStatus()
+	if err != nil {
+		log.WithError(err).Warn("Error reading status file for tray.")
+	} else {
+		t.recent = (&statusOptions{}).sortedBuilds(state)
+		if len(t.recent) > max {
+			t.recent = t.recent[:max]
+		}
+	}
+	t.buildMenu()
+
+	if err := dConn.Export(sniMethods{t}, sniPath, sniIface); err != nil {
+		return err
+	}
+	if err := dConn.Export(menuMethods{t}, menuPath, menuIface); err != nil {
+		return err
+	}
+	icon, status, toolTip := t.appearance()
+	t.props, err = prop.Export(dConn, sniPath, map[string]map[string]*prop.Prop{
+		sniIface: {
+			"Category":   {Value: "ApplicationStatus", Emit: prop.EmitConst},
+			"Id":         {Value: "semnotify", Emit: prop.EmitConst},
+			"Title":      {Value: "Semaphore", Emit: prop.EmitConst},
+			"Status":     {Value: status, Emit: prop.EmitFalse},
+			"WindowId":   {Value: int32(0), Emit: prop.EmitConst},
+			"IconName":   {Value: "", Emit: prop.EmitConst},
+			"IconPixmap": {Value: icon, Emit: prop.EmitFalse},
+			"ToolTip":    {Value: toolTip, Emit: prop.EmitFalse},
+			"ItemIsMenu": {Value: false, Emit: prop.EmitConst},
+			"Menu":       {Value: menuPath, Emit: prop.EmitConst},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := prop.Export(dConn, menuPath, map[string]map[string]*prop.Prop{
+		menuIface: {
+			"Version":       {Value: uint32(3), Emit: prop.EmitConst},
+			"TextDirection": {Value: "ltr", Emit: prop.EmitConst},
+			"Status":        {Value: "normal", Emit: prop.EmitConst},
+			"IconThemePath": {Value: []string{}, Emit: prop.EmitConst},
+		},
+	}); err != nil {
+		return err
+	}
+	watcher := dConn.Object("org.kde.StatusNotifierWatcher", "/StatusNotifierWatcher")
+	if err := watcher.Call("org.kde.StatusNotifierWatcher.RegisterStatusNotifierItem",
+		0, dbusName).Err; err != nil {
+		return fmt.Errorf("registering tray icon: %w", err)
+	}
+	trayIcon = t
+	return nil
+}
+
+// add records a new build, updating the icon and menu.
+func (t *tray) add(bs *buildState) {
+	t.mu.Lock()
+	t.recent = append([]*buildState{bs}, t.recent...)
+	if len(t.recent) > t.max {
+		t.recent = t.recent[:t.max]
+	}
+	t.mu.Unlock()
+	t.update()
+}
+
+// update refreshes the icon, tooltip, and menu.
+func (t *tray) update() {
+	if t.props == nil {
+		// not exported over DBus yet
+		t.buildMenu()
+		return
+	}
+	icon, status, toolTip := t.appearance()
+	t.props.SetMust(sniIface, "IconPixmap", icon)
+	t.props.SetMust(sniIface, "Status", status)
+	t.props.SetMust(sniIface, "ToolTip", toolTip)
+	for _, signal := range []string{"NewIcon", "NewToolTip"} {
+		if err := dConn.Emit(sniPath, sniIface+"."+signal); err != nil {
+			log.WithError(err).Debug("Error updating tray icon.")
+		}
+	}
+	if err := dConn.Emit(sniPath, sniIface+".NewStatus", status); err != nil {
+		log.WithError(err).Debug("Error updating tray icon.")
+	}
+	revision := t.buildMenu()
+	if err := dConn.Emit(menuPath, menuIface+".LayoutUpdated", revision, int32(0)); err != nil {
+		log.WithError(err).Debug("Error updating tray menu.")
+	}
+}
+
+// appearance returns the icon, status, and tooltip for the latest build.
+func (t *tray) appearance() ([]sniPixmap, string, sniToolTip) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := ""
+	toolTip := sniToolTip{Title: "Semaphore", Description: "No builds yet"}
+	if len(t.recent) > 0 {
+		latest := t.recent[0]
+		result = latest.Result
+		toolTip.Description = latest.Summary
+	}
+	if notificationsPaused() {
+		toolTip.Description += "\nNotifications paused"
+	}
+	status := "Active"
+	if result == semrelay.ResultFailed {
+		status = "NeedsAttention"
+	}
+	icon := []sniPixmap{tintedIcon(semrelay.IconImage, result)}
+	toolTip.IconPixmap = icon
+	return icon, status, toolTip
+}
+
+// buildMenu rebuilds the menu items, returning the new layout revision.
+func (t *tray) buildMenu() uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.items = nil
+	for i, bs := range t.recent {
+		symbol, found := resultSymbols[bs.Result]
+		if !found {
+			symbol = "•"
+		}
+		t.items = append(t.items, menuItem{
+			id: int32(i + 1),
+			props: map[string]dbus.Variant{
+				"label": dbus.MakeVariant(fmt.Sprintf("%s %s:%s", symbol, bs.Project, bs.Branch)),
+			},
+			run: openLogged(bs.URL),
+		})
+	}
+	if len(t.recent) == 0 {
+		t.items = append(t.items, menuItem{
+			id: 1,
+			props: map[string]dbus.Variant{
+				"label":   dbus.MakeVariant("No builds yet"),
+				"enabled": dbus.MakeVariant(false),
+			},
+		})
+	}
+	pauseLabel := "Pause notifications"
+	if notificationsPaused() {
+		pauseLabel = "Resume notifications"
+	}
+	t.items = append(t.items,
+		menuItem{
+			id:    menuSeparator,
+			props: map[string]dbus.Variant{"type": dbus.MakeVariant("separator")},
+		},
+		menuItem{
+			id:    menuPause,
+			props: map[string]dbus.Variant{"label": dbus.MakeVariant(pauseLabel)},
+			run:   t.togglePause,
+		},
+		menuItem{
+			id:    menuReconnect,
+			props: map[string]dbus.Variant{"label": dbus.MakeVariant("Reconnect")},
+			run: func() {
+				if relayClient != nil {
+					relayClient.Reconnect()
+				}
+			},
+		},
+	)
+	t.revision++
+	return t.revision
+}
+
+func (t *tray) togglePause() {
+	if atomic.CompareAndSwapInt32(&paused, 0, 1) {
+		log.Info("Notifications paused.")
+	} else {
+		atomic.StoreInt32(&paused, 0)
+		log.Info("Notifications resumed.")
+	}
+	t.update()
+}
+
+func openLogged(url string) func() {
+	return func() {
+		if err := opener(url)(); err != nil {
+			log.WithField("url", url).WithError(err).Error("Error opening URL.")
+		}
+	}
+}
+
+// tintedIcon colors the icon for the result, keeping its shading, and
+// converts it to the StatusNotifierItem pixmap format.
+func tintedIcon(img *image.NRGBA, result string) sniPixmap {
+	color, tint := resultColors[result]
+	b := img.Bounds()
+	data := make([]byte, 0, 4*b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			r, g, bl, a := img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]
+			if tint {
+				lum := (299*uint32(r) + 587*uint32(g) + 114*uint32(bl)) / 1000
+				r = uint8(lum * uint32(color[0]) / 255)
+				g = uint8(lum * uint32(color[1]) / 255)
+				bl = uint8(lum * uint32(color[2]) / 255)
+			}
+			data = append(data, a, r, g, bl)
+		}
+	}
+	return sniPixmap{Width: int32(b.Dx()), Height: int32(b.Dy()), Data: data}
+}
+
+// sniMethods implements the StatusNotifierItem methods.
+type sniMethods struct{ t *tray }
+
+// Activate opens the latest build, on a click on the icon.
+func (m sniMethods) Activate(x, y int32) *dbus.Error {
+	m.t.mu.Lock()
+	var url string
+	if len(m.t.recent) > 0 {
+		url = m.t.recent[0].URL
+	}
+	m.t.mu.Unlock()
+	if url != "" {
+		go openLogged(url)()
+	}
+	return nil
+}
+
+func (sniMethods) SecondaryActivate(x, y int32) *dbus.Error {
+	return nil
+}
+
+func (sniMethods) ContextMenu(x, y int32) *dbus.Error {
+	return nil
+}
+
+func (sniMethods) Scroll(delta int32, orientation string) *dbus.Error {
+	return nil
+}
+
+// menuMethods implements the dbusmenu methods. The menu has one level, so
+// every item is a child of the root, ID 0.
+type menuMethods struct{ t *tray }
+
+func (m menuMethods) GetLayout(parentId, recursionDepth int32, propertyNames []string) (uint32, menuLayout, *dbus.Error) {
+	m.t.mu.Lock()
+	defer m.t.mu.Unlock()
+	if parentId != 0 {
+		for _, item := range m.t.items {
+			if item.id == parentId {
+				return m.t.revision, menuLayout{Id: item.id, Properties: item.props, Children: []dbus.Variant{}}, nil
+			}
+		}
+		return 0, menuLayout{}, dbus.MakeFailedError(fmt.Errorf("no menu item %d", parentId))
+	}
+	root := menuLayout{
+		Properties: map[string]dbus.Variant{"children-display": dbus.MakeVariant("submenu")},
+		Children:   []dbus.Variant{},
+	}
+	if recursionDepth != 0 {
+		for _, item := range m.t.items {
+			root.Children = append(root.Children, dbus.MakeVariant(
+				menuLayout{Id: item.id, Properties: item.props, Children: []dbus.Variant{}}))
+		}
+	}
+	return m.t.revision, root, nil
+}
+
+func (m menuMethods) GetGroupProperties(ids []int32, propertyNames []string) ([]menuItemProperties, *dbus.Error) {
+	m.t.mu.Lock()
+	defer m.t.mu.Unlock()
+	props := []menuItemProperties{}
+	for _, item := range m.t.items {
+		for _, id := range ids {
+			if item.id == id {
+				props = append(props, menuItemProperties{Id: item.id, Properties: item.props})
+			}
+		}
+	}
+	return props, nil
+}
+
+func (m menuMethods) GetProperty(id int32, name string) (dbus.Variant, *dbus.Error) {
+	m.t.mu.Lock()
+	defer m.t.mu.Unlock()
+	for _, item := range m.t.items {
+		if item.id == id {
+			if v, found := item.props[name]; found {
+				return v, nil
+			}
+		}
+	}
+	return dbus.Variant{}, dbus.MakeFailedError(fmt.Errorf("no property %s for menu item %d", name, id))
+}
+
+func (m menuMethods) Event(id int32, eventId string, data dbus.Variant, timestamp uint32) *dbus.Error {
+	if eventId != "clicked" {
+		return nil
+	}
+	m.t.mu.Lock()
+	var run func()
+	for _, item := range m.t.items {
+		if item.id == id {
+			run = item.run
+		}
+	}
+	m.t.mu.Unlock()
+	if run != nil {
+		go run()
+	}
+	return nil
+}
+
+func (m menuMethods) EventGroup(events []menuEvent) ([]int32, *dbus.Error) {
+	for _, e := range events {
+		if err := m.Event(e.Id, e.EventId, e.Data, e.Timestamp); err != nil {
+			return nil, err
+		}
+	}
+	return []int32{}, nil
+}
+
+func (menuMethods) AboutToShow(id int32) (bool, *dbus.Error) {
+	return false, nil
+}
+
+func (menuMethods) AboutToShowGroup(ids []int32) ([]int32, []int32, *dbus.Error) {
+	return []int32{}, []int32{}, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dbus "github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csw/semrelay"
+)
+
+func TestTintedIcon(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+	img.SetNRGBA(1, 0, color.NRGBA{R: 0x00, G: 0x00, B: 0x00, A: 0x80})
+	img.SetNRGBA(2, 0, color.NRGBA{R: 0x10, G: 0x20, B: 0x30, A: 0x00})
+
+	for _, tc := range []struct {
+		result string
+		want   []byte
+	}{
+		// untinted, in ARGB order
+		{"", []byte{0xff, 0xff, 0xff, 0xff, 0x80, 0x00, 0x00, 0x00, 0x00, 0x10, 0x20, 0x30}},
+		{"running", []byte{0xff, 0xff, 0xff, 0xff, 0x80, 0x00, 0x00, 0x00, 0x00, 0x10, 0x20, 0x30}},
+		// white takes the result's color, black stays black, and alpha is kept
+		{semrelay.ResultPassed, []byte{0xff, 0x2e, 0xc2, 0x7e, 0x80, 0x00, 0x00, 0x00, 0x00, 0x05, 0x16, 0x0e}},
+		{semrelay.ResultFailed, []byte{0xff, 0xe0, 0x1b, 0x24, 0x80, 0x00, 0x00, 0x00, 0x00, 0x19, 0x03, 0x04}},
+		{semrelay.ResultStopped, []byte{0xff, 0xf5, 0xc2, 0x11, 0x80, 0x00, 0x00, 0x00, 0x00, 0x1b, 0x16, 0x01}},
+	} {
+		pixmap := tintedIcon(img, tc.result)
+		assert.Equal(t, int32(3), pixmap.Width, tc.result)
+		assert.Equal(t, int32(1), pixmap.Height, tc.result)
+		assert.Equal(t, tc.want, pixmap.Data, tc.result)
+	}
+
+	pixmap := tintedIcon(semrelay.IconImage, semrelay.ResultFailed)
+	b := semrelay.IconImage.Bounds()
+	assert.Len(t, pixmap.Data, 4*b.Dx()*b.Dy())
+}
+
+// usePaused resets notifications to unpaused when the test ends.
+func usePaused(t *testing.T) {
+	t.Cleanup(func() { atomic.StoreInt32(&paused, 0) })
+}
+
+func newTestTray(builds ...*buildState) *tray {
+	t := &tray{max: 10, recent: builds}
+	t.buildMenu()
+	return t
+}
+
+// menuLabels returns the ID and label of each item in the menu layout.
+func menuLabels(t *testing.T, tr *tray) ([]int32, []string) {
+	_, root, err := menuMethods{tr}.GetLayout(0, -1, nil)
+	require.Nil(t, err)
+	var ids []int32
+	var labels []string
+	for _, child := range root.Children {
+		item, ok := child.Value().(menuLayout)
+		require.True(t, ok)
+		ids = append(ids, item.Id)
+		label, _ := item.Properties["label"].Value().(string)
+		labels = append(labels, label)
+	}
+	return ids, labels
+}
+
+func TestTrayMenu(t *testing.T) {
+	usePaused(t)
+	for _, tc := range []struct {
+		name   string
+		builds []*buildState
+		paused bool
+		ids    []int32
+		labels []string
+	}{
+		{
+			name:   "no builds",
+			ids:    []int32{1, menuSeparator, menuPause, menuReconnect},
+			labels: []string{"No builds yet", "", "Pause notifications", "Reconnect"},
+		},
+		{
+			name: "recent builds",
+			builds: []*buildState{
+				testBuild("web", "main", semrelay.ResultFailed, "2024-03-09T12:00:00Z"),
+				testBuild("api", "main", semrelay.ResultPassed, "2024-03-09T11:00:00Z"),
+				testBuild("docs", "main", semrelay.ResultStopped, "2024-03-09T10:00:00Z"),
+			},
+			ids: []int32{1, 2, 3, menuSeparator, menuPause, menuReconnect},
+			labels: []string{"✘ web:main", "✔ api:main", "• docs:main", "",
+				"Pause notifications", "Reconnect"},
+		},
+		{
+			name:   "paused",
+			paused: true,
+			ids:    []int32{1, menuSeparator, menuPause, menuReconnect},
+			labels: []string{"No builds yet", "", "Resume notifications", "Reconnect"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var p int32
+			if tc.paused {
+				p = 1
+			}
+			atomic.StoreInt32(&paused, p)
+			tr := newTestTray(tc.builds...)
+			ids, labels := menuLabels(t, tr)
+			assert.Equal(t, tc.ids, ids)
+			assert.Equal(t, tc.labels, labels)
+		})
+	}
+}
+
+func TestTrayGetLayout(t *testing.T) {
+	tr := newTestTray(testBuild("web", "main", semrelay.ResultFailed, "2024-03-09T12:00:00Z"))
+	m := menuMethods{tr}
+	revision, root, err := m.GetLayout(0, 0, nil)
+	require.Nil(t, err)
+	assert.Equal(t, tr.revision, revision)
+	assert.Empty(t, root.Children, "no children without recursion")
+
+	_, item, err := m.GetLayout(1, -1, nil)
+	require.Nil(t, err)
+	assert.Equal(t, int32(1), item.Id)
+	assert.Equal(t, "✘ web:main", item.Properties["label"].Value())
+	_, _, err = m.GetLayout(99, -1, nil)
+	assert.NotNil(t, err)
+
+	separator, err := m.GetProperty(menuSeparator, "type")
+	require.Nil(t, err)
+	assert.Equal(t, "separator", separator.Value())
+	_, err = m.GetProperty(menuSeparator, "label")
+	assert.NotNil(t, err)
+
+	props, err := m.GetGroupProperties([]int32{menuReconnect, 1, 99}, nil)
+	require.Nil(t, err)
+	require.Len(t, props, 2)
+	assert.Equal(t, int32(1), props[0].Id)
+	assert.Equal(t, menuReconnect, props[1].Id)
+
+	// a new build goes first
+	before := tr.revision
+	tr.add(testBuild("api", "main", semrelay.ResultPassed, "2024-03-09T13:00:00Z"))
+	_, labels := menuLabels(t, tr)
+	assert.Equal(t, []string{"✔ api:main", "✘ web:main"}, labels[:2])
+	assert.Greater(t, tr.revision, before)
+}
+
+func TestTrayAppearance(t *testing.T) {
+	usePaused(t)
+	tr := newTestTray()
+	_, status, toolTip := tr.appearance()
+	assert.Equal(t, "Active", status)
+	assert.Equal(t, "No builds yet", toolTip.Description)
+
+	tr.add(testBuild("web", "main", semrelay.ResultFailed, "2024-03-09T12:00:00Z"))
+	_, status, toolTip = tr.appearance()
+	assert.Equal(t, "NeedsAttention", status)
+	assert.Equal(t, "Build failed for web:main", toolTip.Description)
+
+	atomic.StoreInt32(&paused, 1)
+	_, _, toolTip = tr.appearance()
+	assert.Equal(t, "Build failed for web:main\nNotifications paused", toolTip.Description)
+}
+
+func TestTrayClicks(t *testing.T) {
+	usePaused(t)
+	tr := newTestTray(
+		testBuild("web", "main", semrelay.ResultFailed, "2024-03-09T12:00:00Z"),
+		testBuild("api", "main", semrelay.ResultPassed, "2024-03-09T11:00:00Z"),
+	)
+	// record clicks on the builds rather than opening them
+	clicked := make(chan int32, 8)
+	tr.mu.Lock()
+	for i := range tr.items {
+		if id := tr.items[i].id; id < menuSeparator {
+			tr.items[i].run = func() { clicked <- id }
+		}
+	}
+	tr.mu.Unlock()
+	m := menuMethods{tr}
+
+	require.Nil(t, m.Event(2, "clicked", dbus.MakeVariant(""), 0))
+	select {
+	case id := <-clicked:
+		assert.Equal(t, int32(2), id)
+	case <-time.After(2 * time.Second):
+		t.Fatal("click not handled")
+	}
+
+	// only clicks count
+	require.Nil(t, m.Event(1, "hovered", dbus.MakeVariant(""), 0))
+	// unknown items and the separator are ignored
+	require.Nil(t, m.Event(99, "clicked", dbus.MakeVariant(""), 0))
+	require.Nil(t, m.Event(menuSeparator, "clicked", dbus.MakeVariant(""), 0))
+
+	_, err := m.EventGroup([]menuEvent{
+		{Id: 1, EventId: "clicked", Data: dbus.MakeVariant("")},
+		{Id: menuPause, EventId: "clicked", Data: dbus.MakeVariant("")},
+	})
+	require.Nil(t, err)
+	select {
+	case id := <-clicked:
+		assert.Equal(t, int32(1), id)
+	case <-time.After(2 * time.Second):
+		t.Fatal("click not handled")
+	}
+	require.Eventually(t, notificationsPaused, 2*time.Second, 5*time.Millisecond)
+	require.Eventually(t, func() bool {
+		_, labels := menuLabels(t, tr)
+		return labels[len(labels)-2] == "Resume notifications"
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.Empty(t, clicked)
+
+	// and again to resume
+	require.Nil(t, m.Event(menuPause, "clicked", dbus.MakeVariant(""), 0))
+	require.Eventually(t, func() bool { return !notificationsPaused() }, 2*time.Second, 5*time.Millisecond)
+}
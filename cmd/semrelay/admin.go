@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/csw/semrelay"
+	internal "github.com/csw/semrelay/internal"
+	"github.com/csw/semrelay/relay"
+)
+
+// The admin API is served under /admin/users:
+//
+//	GET    /admin/users                              list users and clients
+//	GET    /admin/users/{user}/queue                 dump pending notifications
+//	DELETE /admin/users/{user}/notifications/{id}    purge a notification
+//	POST   /admin/users/{user}/notifications/{id}    requeue a notification
+//	DELETE /admin/users/{user}/clients/{addr}        disconnect a client
+//
+// Notifications for testing are sent with adminTestPath.
+const adminPrefix = "/admin/users"
+
+// adminTestPath is the endpoint for sending test notifications:
+//
+//	POST /admin/test?user={user}&kind={success|failure}
+//
+// Test notifications are marked as such in the message envelope. They use
+// the request body as the Semaphore payload, or an example success or failure
+// if the body is empty. The response says where the notification went, as a
+// testResult; if the user has never connected and there are no other
+// instances to pass it to, nothing is sent and it fails with 404.
+const adminTestPath = "/admin/test"
+
+// testResult describes where a test notification was sent.
+type testResult struct {
+	OK bool `json:"ok"`
+	// Clients is the number of the user's clients connected to this
+	// instance, which were sent the notification.
+	Clients int `json:"clients"`
+	// Queued is set if none of the user's clients are connected to this
+	// instance, so it's held for the next one to connect.
+	Queued bool `json:"queued,omitempty"`
+	// Forwarded is set if the user isn't known to this instance, so it was
+	// only passed on to other instances.
+	Forwarded bool `json:"forwarded,omitempty"`
+}
+
+func handleAdmin(d *relay.Dispatcher, w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	var parts []string
+	if rest := strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), adminPrefix), "/"); rest != "" {
+		for _, part := range strings.Split(rest, "/") {
+			unescaped, err := url.PathUnescape(part)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			parts = append(parts, unescaped)
+		}
+	}
+	if len(parts) == 0 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		adminListUsers(ctx, d, w)
+		return
+	}
+	user, err := d.User(ctx, parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if user == nil {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+	alog := log.WithFields(log.Fields{"user": user.Name, "remote": r.RemoteAddr})
+	switch {
+	case len(parts) == 2 && parts[1] == "queue" && r.Method == http.MethodGet:
+		dump, err := user.Queue(ctx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, dump)
+	case len(parts) == 3 && parts[1] == "notifications":
+		id, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			http.Error(w, "invalid notification id", http.StatusBadRequest)
+			return
+		}
+		var found bool
+		var event string
+		switch r.Method {
+		case http.MethodDelete:
+			alog.WithField("id", id).Info("Purging notification")
+			event = "purge"
+			found, err = user.Purge(ctx, id)
+		case http.MethodPost:
+			alog.WithField("id", id).Info("Requeuing notification")
+			event = "requeue"
+			found, err = user.Requeue(ctx, id)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		audit(event, log.Fields{"user": user.Name, "id": id, "found": found,
+			"remote": remoteIP(r)})
+		writeFound(w, found, err, "no such notification")
+	case len(parts) == 3 && parts[1] == "clients" && r.Method == http.MethodDelete:
+		alog.WithField("client", parts[2]).Info("Kicking client")
+		found, err := user.Kick(ctx, parts[2])
+		audit("kick", log.Fields{"user": user.Name, "conn": parts[2], "reason": "admin",
+			"found": found, "remote": remoteIP(r)})
+		writeFound(w, found, err, "no such client")
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func adminListUsers(ctx context.Context, d *relay.Dispatcher, w http.ResponseWriter) {
+	users, err := d.Status(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, users)
+}
+
+func handleAdminTest(d *relay.Dispatcher, b relay.Broker, w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		http.Error(w, "no user specified", http.StatusBadRequest)
+		return
+	}
+	var example []byte
+	switch kind := r.URL.Query().Get("kind"); kind {
+	case "", "success":
+		example = internal.ExampleSuccess
+	case "failure":
+		example = internal.ExampleFailure
+	default:
+		http.Error(w, "unknown kind "+kind, http.StatusBadRequest)
+		return
+	}
+	body, n, ok := readPayload(w, r, example)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	result, err := testDestination(ctx, d, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !result.OK {
+		http.Error(w, "user has not connected to this server; nothing was sent", http.StatusNotFound)
+		return
+	}
+	log.WithFields(log.Fields{"user": user, "remote": r.RemoteAddr}).
+		Info("Sending test notification")
+	audit("test", log.Fields{"user": user, "pipeline": n.Pipeline.Id, "remote": remoteIP(r)})
+	b.DispatchTest(user, body)
+	writeJSON(w, result)
+}
+
+// testDestination works out where a test notification for the user would
+// go. OK is false if it would go nowhere.
+func testDestination(ctx context.Context, d *relay.Dispatcher, name string) (*testResult, error) {
+	user, err := d.User(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return &testResult{OK: redisBroker != nil, Forwarded: redisBroker != nil}, nil
+	}
+	status, err := user.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &testResult{
+		OK:      true,
+		Clients: len(status.Clients),
+		Queued:  len(status.Clients) == 0,
+	}, nil
+}
+
+// readPayload reads a Semaphore payload from the request body, or uses def if
+// the body is empty. It writes an error response if the payload is invalid.
+func readPayload(w http.ResponseWriter, r *http.Request, def []byte) ([]byte, *semrelay.Notification, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if len(body) == 0 {
+		body = def
+	}
+	var n semrelay.Notification
+	if err := json.Unmarshal(body, &n); err != nil {
+		http.Error(w, "invalid notification: "+err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+	return body, &n, true
+}
+
+func writeFound(w http.ResponseWriter, found bool, err error, missing string) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !found {
+		http.Error(w, missing, http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]bool{"ok": true})
+}
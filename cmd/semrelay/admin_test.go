@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csw/semrelay"
+	"github.com/csw/semrelay/relay"
+)
+
+// fakeClient is a relay client that records what it's sent.
+type fakeClient struct {
+	helloCh chan struct{}
+	msgCh   chan *relay.NotificationTask
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		helloCh: make(chan struct{}, 1),
+		msgCh:   make(chan *relay.NotificationTask, 8),
+	}
+}
+
+func (c *fakeClient) String() string { return "fake" }
+func (c *fakeClient) Hello()         { c.helloCh <- struct{}{} }
+func (c *fakeClient) Disconnect()    {}
+
+func (c *fakeClient) TrySend(msg *relay.NotificationTask) bool {
+	c.msgCh <- msg
+	return true
+}
+
+func (c *fakeClient) TryDismiss(id uint64) bool { return true }
+
+func adminTest(d *relay.Dispatcher, user string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", adminTestPath+"?user="+user, nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	handleAdminTest(d, d, w, r)
+	return w
+}
+
+func TestAdminTest(t *testing.T) {
+	applyConfig(&config{AdminToken: "admin", LogLevel: log.GetLevel()})
+	d := relay.NewDispatcher()
+	go d.Run()
+
+	w := adminTest(d, "alice")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "nothing was sent")
+
+	client := newFakeClient()
+	user := d.Register("alice", client)
+	<-client.helloCh
+	w = adminTest(d, "alice")
+	require.Equal(t, http.StatusOK, w.Code)
+	var result testResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, testResult{OK: true, Clients: 1}, result)
+	task := <-client.msgCh
+	var msg semrelay.Message
+	require.NoError(t, json.Unmarshal(task.Payload, &msg))
+	assert.True(t, msg.Test)
+
+	user.Leave(client)
+	require.Eventually(t, func() bool {
+		status, err := user.Status(context.Background())
+		return err == nil && len(status.Clients) == 0
+	}, time.Second, 10*time.Millisecond)
+	w = adminTest(d, "alice")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, testResult{OK: true, Queued: true}, result)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/csw/semrelay/relay"
+)
+
+// auditLog records security-relevant events as JSON lines, separately from
+// the diagnostic log. It's nil if no audit log is configured.
+var auditLog *log.Logger
+
+// openAuditLog opens the audit log file named by the audit_log setting, which
+// is rotated when it reaches audit_max_size megabytes.
+func openAuditLog() {
+	file := viper.GetString("audit_log")
+	if file == "" {
+		return
+	}
+	auditLog = log.New()
+	auditLog.SetFormatter(&log.JSONFormatter{
+		FieldMap: log.FieldMap{log.FieldKeyMsg: "event"},
+	})
+	auditLog.SetOutput(&lumberjack.Logger{
+		Filename:   file,
+		MaxSize:    viper.GetInt("audit_max_size"),
+		MaxBackups: viper.GetInt("audit_max_backups"),
+		MaxAge:     viper.GetInt("audit_max_age"),
+	})
+	relay.SlowConsumerHook = func(user string, client relay.Client) {
+		audit("kick", log.Fields{"user": user, "conn": client.String(), "reason": "slow_consumer"})
+	}
+}
+
+// audit records an event. Callers must not include secrets in the fields.
+func audit(event string, fields log.Fields) {
+	if auditLog == nil {
+		return
+	}
+	auditLog.WithFields(fields).Info(event)
+}
+
+// remoteIP returns the IP address the request came from.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
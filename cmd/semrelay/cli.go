@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const adminUsage = `Usage: semrelay admin [flags] COMMAND [ARGS]
+
+Commands:
+  users                 list users and their connected clients
+  queue USER            show USER's queued and in-flight notifications
+  purge USER ID         discard a pending notification
+  requeue USER ID       resend a pending notification
+  kick USER CLIENT      disconnect one of USER's clients, by address
+  test USER [KIND|FILE] send USER a test notification: an example success or
+                        failure, as KIND, or the payload in FILE
+
+Flags:
+`
+
+// runAdmin implements the admin subcommands, which call the admin API of a
+// running server.
+func runAdmin(args []string) error {
+	flags := pflag.NewFlagSet("admin", pflag.ContinueOnError)
+	server := flags.String("server", "",
+		"server base URL, e.g. https://semrelay.example.com (env SEMRELAY_URL)")
+	token := flags.String("token", "", "admin token (env ADMIN_TOKEN)")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, adminUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *server == "" {
+		*server = os.Getenv("SEMRELAY_URL")
+	}
+	if *token == "" {
+		*token = os.Getenv("ADMIN_TOKEN")
+	}
+	if *server == "" {
+		return errors.New("must specify --server or SEMRELAY_URL")
+	}
+	if *token == "" {
+		return errors.New("must specify --token or ADMIN_TOKEN")
+	}
+	api := &adminClient{server: strings.TrimSuffix(*server, "/"), token: *token}
+
+	args = flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		return errors.New("no command specified")
+	}
+	cmd, args := args[0], args[1:]
+	want := map[string]int{"users": 0, "queue": 1, "purge": 2, "requeue": 2, "kick": 2}
+	if n, ok := want[cmd]; ok && len(args) != n {
+		return fmt.Errorf("%s takes %d arguments", cmd, n)
+	}
+	switch cmd {
+	case "users":
+		return api.do(http.MethodGet, nil)
+	case "queue":
+		return api.do(http.MethodGet, nil, args[0], "queue")
+	case "purge":
+		return api.do(http.MethodDelete, nil, args[0], "notifications", args[1])
+	case "requeue":
+		return api.do(http.MethodPost, nil, args[0], "notifications", args[1])
+	case "kick":
+		return api.do(http.MethodDelete, nil, args[0], "clients", args[1])
+	case "test":
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("test takes 1 or 2 arguments")
+		}
+		query := url.Values{"user": {args[0]}}
+		var body []byte
+		if len(args) == 2 {
+			if args[1] == "success" || args[1] == "failure" {
+				query.Set("kind", args[1])
+			} else {
+				var err error
+				if body, err = os.ReadFile(args[1]); err != nil {
+					return err
+				}
+			}
+		}
+		return api.request(http.MethodPost, api.server+adminTestPath+"?"+query.Encode(), body)
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown command %s", cmd)
+	}
+}
+
+type adminClient struct {
+	server string
+	token  string
+}
+
+// do calls the admin API at the given path under /admin/users and prints the
+// response.
+func (c *adminClient) do(method string, body []byte, path ...string) error {
+	u := c.server + adminPrefix
+	for _, part := range path {
+		u += "/" + url.PathEscape(part)
+	}
+	return c.request(method, u, body)
+}
+
+// request calls the admin API at the given URL and prints the response.
+func (c *adminClient) request(method, u string, body []byte) error {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(resBody)))
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, resBody, "", "  "); err != nil {
+		_, err = os.Stdout.Write(resBody)
+		return err
+	}
+	_, err = fmt.Println(out.String())
+	return err
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+
+	"github.com/csw/semrelay"
+)
+
+// route sends notifications matching its patterns to additional users, as
+// well as to the user who triggered the build. Empty patterns match anything;
+// others are matched with path.Match.
+type route struct {
+	Repository string   `mapstructure:"repository"`
+	Project    string   `mapstructure:"project"`
+	Branch     string   `mapstructure:"branch"`
+	Users      []string `mapstructure:"users"`
+}
+
+// config holds the settings that can be changed by reloading the
+// configuration with SIGHUP. Settings that only take effect at startup, such
+// as the domain and listen port, are kept in package variables.
+type config struct {
+	Password   string
+	Token      string
+	AdminToken string
+	Routes     []route
+	LogLevel   log.Level
+	// AllowedOrigins are patterns for the Origin header of WebSocket
+	// requests. If empty, browsers may only connect from the same host.
+	AllowedOrigins []string
+	// HookDedupWindow is how long to remember pipeline results, to ignore
+	// webhooks Semaphore delivers again. Zero disables this.
+	HookDedupWindow time.Duration
+}
+
+var curConfig atomic.Value
+
+func currentConfig() *config {
+	return curConfig.Load().(*config)
+}
+
+func defineFlags() {
+	pflag.StringP("config", "c", "", "Configuration file, in YAML or TOML (env CONFIG)")
+	pflag.String("domain", "", "DNS domain names to acquire certificates for, separated by commas")
+	pflag.String("email", "", "Email address for Let's Encrypt")
+	pflag.Bool("staging", false, "Use the Let's Encrypt staging CA")
+	pflag.String("acme-ca", "", "ACME directory URL, instead of Let's Encrypt")
+	pflag.String("acme-ca-root", "", "PEM file of CA certificates to trust for the ACME server")
+	pflag.String("cert-file", "", "TLS certificate file, instead of using ACME")
+	pflag.String("key-file", "", "TLS private key file, for --cert-file")
+	pflag.String("client-ca", "", "PEM file of CA certificates; if set, clients must authenticate with a certificate")
+	pflag.Bool("http-only", false, "Serve plain HTTP instead of HTTPS")
+	pflag.String("port", "80", "Port for plain HTTP")
+	pflag.String("http-addr", "", "Address for plain HTTP, instead of --port")
+	pflag.String("https-addr", ":443", "Address for HTTPS")
+	pflag.String("audit-log", "", "File to write the audit log to, as JSON lines")
+	pflag.Int("audit-max-size", 100, "Size in megabytes at which to rotate the audit log")
+	pflag.Int("audit-max-backups", 10, "Number of rotated audit logs to keep, or 0 for all")
+	pflag.Int("audit-max-age", 0, "Days to keep rotated audit logs, or 0 to keep them regardless of age")
+	pflag.String("base-path", "", "Path prefix to serve under, e.g. /semrelay")
+	pflag.String("trusted-proxies", "", "IP ranges of reverse proxies whose forwarding headers are trusted, separated by commas")
+	pflag.Bool("proxy-protocol", false, "Accept PROXY protocol headers from trusted proxies")
+	pflag.String("allowed-origins", "", "Origin patterns allowed to open WebSockets, separated by commas, or * for any")
+	pflag.String("redis-url", "", "Redis URL, to share notifications with other instances, e.g. redis://localhost:6379/0")
+	pflag.String("redis-channel", "semrelay", "Redis pub/sub channel for sharing notifications")
+	pflag.String("metrics-addr", "", "Address to serve Prometheus metrics on")
+	pflag.Duration("hook-dedup-window", 10*time.Minute, "How long to ignore repeated webhooks for a pipeline result, or 0 to never")
+	pflag.String("log-level", "info", "Log level")
+	pflag.BoolP("verbose", "v", false, "Verbose mode, same as --log-level=debug")
+}
+
+// parseConfig reads the configuration from the command line, the environment,
+// and the configuration file if any. Environment variables are the upper-case
+// setting names, e.g. ADMIN_TOKEN. Secrets can only be set in the environment
+// or configuration file, not on the command line.
+func parseConfig() error {
+	defineFlags()
+	pflag.Parse()
+	pflag.CommandLine.VisitAll(func(f *pflag.Flag) {
+		key := strings.ReplaceAll(f.Name, "-", "_")
+		if err := viper.BindPFlag(key, f); err != nil {
+			panic(err)
+		}
+	})
+	viper.AutomaticEnv()
+	if cfg := viper.GetString("config"); cfg != "" {
+		viper.SetConfigFile(cfg)
+		if err := viper.ReadInConfig(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadConfig builds the reloadable configuration from viper's current state.
+func loadConfig() (*config, error) {
+	cfg := &config{
+		Password:   viper.GetString("password"),
+		Token:      viper.GetString("token"),
+		AdminToken: viper.GetString("admin_token"),
+		LogLevel:   log.InfoLevel,
+
+		AllowedOrigins:  splitList(viper.GetStringSlice("allowed_origins")),
+		HookDedupWindow: viper.GetDuration("hook_dedup_window"),
+	}
+	if cfg.Password == "" {
+		return nil, errors.New("must specify PASSWORD")
+	}
+	if cfg.Token == "" {
+		return nil, errors.New("must specify TOKEN")
+	}
+	if err := viper.UnmarshalKey("routes", &cfg.Routes); err != nil {
+		return nil, fmt.Errorf("invalid routes: %w", err)
+	}
+	for _, r := range cfg.Routes {
+		for _, pattern := range []string{r.Repository, r.Project, r.Branch} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid route pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	for _, pattern := range cfg.AllowedOrigins {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid origin pattern %q: %w", pattern, err)
+		}
+	}
+	if verbose() {
+		cfg.LogLevel = log.DebugLevel
+	} else if level := viper.GetString("log_level"); level != "" {
+		parsed, err := log.ParseLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		cfg.LogLevel = parsed
+	}
+	return cfg, nil
+}
+
+// verbose reports whether verbose mode is on. As before there was a
+// configuration file, any non-empty VERBOSE environment variable turns it on.
+func verbose() bool {
+	return viper.GetBool("verbose") || os.Getenv("VERBOSE") != ""
+}
+
+// splitList accepts a setting given as a list, or as a comma- or
+// space-separated string.
+func splitList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		list = append(list, strings.FieldsFunc(v, func(r rune) bool {
+			return r == ',' || r == ' '
+		})...)
+	}
+	return list
+}
+
+func applyConfig(cfg *config) {
+	log.SetLevel(cfg.LogLevel)
+	curConfig.Store(cfg)
+}
+
+// reloadOnHangup rereads the configuration file when SIGHUP is received. The
+// new settings apply to subsequent requests and registrations; existing
+// connections are unaffected.
+func reloadOnHangup() {
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, unix.SIGHUP)
+	for range hupCh {
+		if err := reloadConfig(); err != nil {
+			log.WithError(err).Error("Failed to reload configuration, keeping current settings")
+			continue
+		}
+		if staticCert != nil {
+			if err := staticCert.reload(); err != nil {
+				log.WithError(err).Error("Failed to reload certificate, keeping current one")
+			}
+		}
+	}
+}
+
+// reloadConfig rereads the configuration file, if any, and applies it if it's
+// valid.
+func reloadConfig() error {
+	if viper.ConfigFileUsed() != "" {
+		if err := viper.ReadInConfig(); err != nil {
+			return err
+		}
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	applyConfig(cfg)
+	log.WithField("routes", len(cfg.Routes)).Info("Reloaded configuration")
+	return nil
+}
+
+// recipients returns the users to send the notification to: the user who
+// triggered the build, plus any users from matching routes.
+func (cfg *config) recipients(n *semrelay.Notification) []string {
+	users := []string{n.Revision.Sender.Login}
+	seen := map[string]bool{n.Revision.Sender.Login: true}
+	for _, r := range cfg.Routes {
+		if !r.matches(n) {
+			continue
+		}
+		for _, user := range r.Users {
+			if !seen[user] {
+				seen[user] = true
+				users = append(users, user)
+			}
+		}
+	}
+	return users
+}
+
+func (r *route) matches(n *semrelay.Notification) bool {
+	return globMatch(r.Repository, n.Repository.Slug) &&
+		globMatch(r.Project, n.Project.Name) &&
+		globMatch(r.Branch, n.Revision.Branch.Name)
+}
+
+func globMatch(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(pattern, s)
+	return matched
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csw/semrelay"
+)
+
+// useConfigFile points viper at a configuration file with the given
+// contents, resetting it when the test ends.
+func useConfigFile(t *testing.T, name, contents string) string {
+	t.Cleanup(viper.Reset)
+	file := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(file, []byte(contents), 0o600))
+	viper.SetConfigFile(file)
+	require.NoError(t, viper.ReadInConfig())
+	return file
+}
+
+const testConfig = `
+password: secret
+token: hook-token
+admin_token: admin
+log_level: warn
+allowed_origins: "https://a.example.com, https://*.example.org"
+routes:
+  - repository: acme/*
+    branch: main
+    users: [alice, bob]
+  - project: tools
+    users: [carol]
+`
+
+func TestLoadConfig(t *testing.T) {
+	useConfigFile(t, "semrelay.yaml", testConfig)
+	cfg, err := loadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "secret", cfg.Password)
+	assert.Equal(t, "hook-token", cfg.Token)
+	assert.Equal(t, "admin", cfg.AdminToken)
+	assert.Equal(t, log.WarnLevel, cfg.LogLevel)
+	assert.Equal(t, []string{"https://a.example.com", "https://*.example.org"}, cfg.AllowedOrigins)
+	require.Len(t, cfg.Routes, 2)
+	assert.Equal(t, route{Repository: "acme/*", Branch: "main", Users: []string{"alice", "bob"}}, cfg.Routes[0])
+	assert.Equal(t, route{Project: "tools", Users: []string{"carol"}}, cfg.Routes[1])
+}
+
+func TestLoadConfigTOML(t *testing.T) {
+	useConfigFile(t, "semrelay.toml", `
+password = "secret"
+token = "hook-token"
+
+[[routes]]
+branch = "release-*"
+users = ["alice"]
+`)
+	cfg, err := loadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []route{{Branch: "release-*", Users: []string{"alice"}}}, cfg.Routes)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for name, contents := range map[string]string{
+		"no password":    "token: t\n",
+		"no token":       "password: p\n",
+		"bad route":      "password: p\ntoken: t\nroutes: [{branch: '[', users: [a]}]\n",
+		"bad origin":     "password: p\ntoken: t\nallowed_origins: '['\n",
+		"bad log level":  "password: p\ntoken: t\nlog_level: loud\n",
+		"malformed list": "password: p\ntoken: t\nroutes: 3\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			useConfigFile(t, "semrelay.yaml", contents)
+			_, err := loadConfig()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	for _, value := range []string{"1", "true", "yes", "on"} {
+		t.Run(value, func(t *testing.T) {
+			useConfigFile(t, "semrelay.yaml", "password: p\ntoken: t\n")
+			t.Setenv("VERBOSE", value)
+			cfg, err := loadConfig()
+			require.NoError(t, err)
+			assert.Equal(t, log.DebugLevel, cfg.LogLevel)
+		})
+	}
+	useConfigFile(t, "semrelay.yaml", "password: p\ntoken: t\n")
+	t.Setenv("VERBOSE", "")
+	cfg, err := loadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, log.InfoLevel, cfg.LogLevel)
+}
+
+func TestReloadConfig(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	file := useConfigFile(t, "semrelay.yaml", "password: old\ntoken: t\n")
+	require.NoError(t, reloadConfig())
+	assert.Equal(t, "old", currentConfig().Password)
+
+	require.NoError(t, os.WriteFile(file, []byte("password: new\ntoken: t\n"), 0o600))
+	require.NoError(t, reloadConfig())
+	assert.Equal(t, "new", currentConfig().Password)
+
+	// an invalid configuration leaves the current one in place
+	require.NoError(t, os.WriteFile(file, []byte("token: t\n"), 0o600))
+	assert.Error(t, reloadConfig())
+	assert.Equal(t, "new", currentConfig().Password)
+}
+
+func testNotification(repository, project, branch, sender string) *semrelay.Notification {
+	var n semrelay.Notification
+	n.Repository.Slug = repository
+	n.Project.Name = project
+	n.Revision.Branch.Name = branch
+	n.Revision.Sender.Login = sender
+	return &n
+}
+
+func TestRecipients(t *testing.T) {
+	useConfigFile(t, "semrelay.yaml", testConfig)
+	cfg, err := loadConfig()
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		name       string
+		n          *semrelay.Notification
+		recipients []string
+	}{
+		{"no match", testNotification("other/repo", "repo", "main", "dave"), []string{"dave"}},
+		{"repository and branch", testNotification("acme/api", "api", "main", "dave"), []string{"dave", "alice", "bob"}},
+		{"wrong branch", testNotification("acme/api", "api", "dev", "dave"), []string{"dave"}},
+		{"glob doesn't cross slashes", testNotification("acme/api/x", "api", "main", "dave"), []string{"dave"}},
+		{"project", testNotification("other/tools", "tools", "dev", "dave"), []string{"dave", "carol"}},
+		{"several routes", testNotification("acme/tools", "tools", "main", "dave"), []string{"dave", "alice", "bob", "carol"}},
+		{"sender not repeated", testNotification("acme/api", "api", "main", "alice"), []string{"alice", "bob"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.recipients, cfg.recipients(tc.n))
+		})
+	}
+}
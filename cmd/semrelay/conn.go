@@ -11,6 +11,8 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"syscall"
 	"time"
 
@@ -38,21 +40,53 @@ const (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin,
+}
+
+// checkOrigin allows WebSocket requests from non-browser clients, which don't
+// send an Origin header, and from origins matching the configured patterns.
+// Without any patterns, it allows the same host, like gorilla's default.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	patterns := currentConfig().AllowedOrigins
+	if len(patterns) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, pattern := range patterns {
+		if pattern == "*" || globMatch(pattern, origin) {
+			return true
+		}
+	}
+	log.WithFields(log.Fields{"conn": r.RemoteAddr, "origin": origin}).
+		Error("WebSocket origin not allowed")
+	return false
 }
 
 type Client struct {
 	dispatcher *relay.Dispatcher
+	broker     relay.Broker
 	user       *relay.User
 
+	// The client's address, which may have been forwarded by a proxy.
+	addr string
+
 	// The websocket connection.
 	conn *websocket.Conn
 
 	// Buffered channel of outbound messages.
 	send chan []byte
+
+	// The user named by the client certificate, if client certificates are
+	// required.
+	certUser string
 }
 
 func (c *Client) String() string {
-	return c.conn.RemoteAddr().String()
+	return c.addr
 }
 
 func (c *Client) log() *log.Entry {
@@ -83,12 +117,27 @@ func (c *Client) TrySend(msg *relay.NotificationTask) bool {
 	}
 }
 
+func (c *Client) TryDismiss(id uint64) bool {
+	enc, err := json.Marshal(semrelay.MakeDismiss(id))
+	if err != nil {
+		panic(err)
+	}
+	select {
+	case c.send <- enc:
+		c.log().WithField("id", id).Debug("Sent dismissal")
+		return true
+	default:
+		c.log().Error("Queue full, failed to send dismissal")
+		return false
+	}
+}
+
 func (c *Client) Disconnect() {
 	log.WithField("conn", c.String()).Debug("Disconnecting client")
 	close(c.send)
 }
 
-// readPump reads registration and acknowledgemnt messages from the notification
+// readPump reads registration, acknowledgement, and dismissal messages from the notification
 // client.
 func (c *Client) readPump() {
 	defer c.conn.Close()
@@ -103,8 +152,14 @@ func (c *Client) readPump() {
 	ulog := log.WithField("user", username).WithField("conn", c.String())
 	if err != nil {
 		ulog.WithError(err).Error("Registration failed")
+		reason := registrationFailureReason(err)
+		registrationFailures.WithLabelValues(reason).Inc()
+		audit("registration", log.Fields{"result": "rejected", "reason": reason,
+			"user": username, "conn": c.String()})
 		return
 	}
+	audit("registration", log.Fields{"result": "accepted", "user": username,
+		"conn": c.String(), "client_cert": c.certUser != ""})
 	c.user = c.dispatcher.Register(username, c)
 	defer func() {
 		c.user.Leave(c)
@@ -124,7 +179,11 @@ func (c *Client) readPump() {
 		}
 		switch msg.Type {
 		case semrelay.AckMsg:
-			c.user.Ack(msg.Id)
+			audit("ack", log.Fields{"user": username, "conn": c.String(), "id": msg.Id})
+			c.broker.Ack(c.user, msg.Id)
+		case semrelay.DismissMsg:
+			audit("dismiss", log.Fields{"user": username, "conn": c.String(), "id": msg.Id})
+			c.broker.Dismiss(c.user, c, msg.Id)
 		default:
 			ulog.WithField("type", msg.Type).Error("Unexpected message from client")
 		}
@@ -135,24 +194,52 @@ func (c *Client) awaitRegister() (string, error) {
 	var msg semrelay.Message
 	err := c.conn.ReadJSON(&msg)
 	if err != nil {
-		return "", err
+		return "", &registrationError{reason: "read", err: err}
 	}
 	if msg.Type != semrelay.RegistrationMsg {
-		return "", fmt.Errorf("Expected registration message, got %s", msg.Type)
+		return "", &registrationError{reason: "unexpected_message",
+			err: fmt.Errorf("Expected registration message, got %s", msg.Type)}
 	}
 	var reg semrelay.Registration
 	if err := json.Unmarshal(msg.Payload, &reg); err != nil {
-		return "", err
+		return "", &registrationError{reason: "malformed", err: err}
+	}
+	if reg.User == "" && c.certUser != "" {
+		reg.User = c.certUser
 	}
 	if reg.User == "" {
-		return "", errors.New("no user specified")
+		return "", &registrationError{reason: "no_user", err: errors.New("no user specified")}
 	}
-	if reg.Password != password {
-		return "", errors.New("password mismatch")
+	if c.certUser != "" {
+		if reg.User != c.certUser {
+			return reg.User, &registrationError{reason: "cert_user",
+				err: fmt.Errorf("certificate is for user %s", c.certUser)}
+		}
+		return reg.User, nil
+	}
+	if reg.Password != currentConfig().Password {
+		return reg.User, &registrationError{reason: "password", err: errors.New("password mismatch")}
 	}
 	return reg.User, nil
 }
 
+// registrationError records why a registration attempt failed, for metrics.
+type registrationError struct {
+	reason string
+	err    error
+}
+
+func (e *registrationError) Error() string { return e.err.Error() }
+func (e *registrationError) Unwrap() error { return e.err }
+
+func registrationFailureReason(err error) string {
+	var regErr *registrationError
+	if errors.As(err, &regErr) {
+		return regErr.reason
+	}
+	return "unknown"
+}
+
 // writePump pumps messages from the hub to the websocket connection.
 //
 // A goroutine running writePump is started for each connection. The
@@ -192,13 +279,31 @@ func (c *Client) writePump() {
 }
 
 // serveWs handles websocket requests from the peer.
-func serveWs(disp *relay.Dispatcher, w http.ResponseWriter, r *http.Request) {
+func serveWs(disp *relay.Dispatcher, broker relay.Broker, w http.ResponseWriter, r *http.Request) {
+	var certUser string
+	if clientCAs != nil {
+		if certUser = clientCertUser(r); certUser == "" {
+			log.WithField("conn", r.RemoteAddr).Error("No client certificate")
+			registrationFailures.WithLabelValues("client_cert").Inc()
+			audit("registration", log.Fields{"result": "rejected", "reason": "client_cert",
+				"conn": r.RemoteAddr})
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	client := &Client{dispatcher: disp, conn: conn, send: make(chan []byte, 32)}
+	client := &Client{
+		dispatcher: disp,
+		broker:     broker,
+		addr:       r.RemoteAddr,
+		conn:       conn,
+		send:       make(chan []byte, 32),
+		certUser:   certUser,
+	}
 
 	go client.writePump()
 	go client.readPump()
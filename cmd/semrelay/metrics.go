@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	hooksReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "semrelay_hooks_received_total",
+		Help: "Webhook requests received from Semaphore.",
+	})
+
+	hooksRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "semrelay_hooks_rejected_total",
+		Help: "Webhook requests rejected, by reason.",
+	}, []string{"reason"})
+
+	hooksDeduplicated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "semrelay_hooks_deduplicated_total",
+		Help: "Webhook requests ignored as redeliveries of earlier ones.",
+	})
+
+	registrationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "semrelay_registration_failures_total",
+		Help: "Failed client registrations, by reason.",
+	}, []string{"reason"})
+)
+
+// serveMetrics serves Prometheus metrics on a separate listener, so that they
+// needn't be exposed publicly.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.WithField("addr", addr).Info("Serving metrics")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.WithError(err).Fatal("Metrics listener failed")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// trustedProxies are the networks of reverse proxies whose forwarding
+// headers and PROXY protocol headers are believed.
+type trustedProxies []*net.IPNet
+
+var proxies trustedProxies
+
+// parseTrustedProxies parses a list of CIDR ranges or single IP addresses.
+func parseTrustedProxies(list []string) (trustedProxies, error) {
+	var t trustedProxies
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", s)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			t = append(t, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %q: %w", s, err)
+		}
+		t = append(t, ipNet)
+	}
+	return t, nil
+}
+
+func (t trustedProxies) contains(ip net.IP) bool {
+	for _, ipNet := range t {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// strings returns the ranges in the form go-proxyproto accepts.
+func (t trustedProxies) strings() []string {
+	var s []string
+	for _, ipNet := range t {
+		s = append(s, ipNet.String())
+	}
+	return s
+}
+
+// listen listens on addr, accepting PROXY protocol headers from trusted
+// proxies if enabled.
+func listen(addr string, proxyProtocol bool) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil || !proxyProtocol {
+		return ln, err
+	}
+	policy, err := proxyproto.StrictWhiteListPolicy(proxies.strings())
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &proxyproto.Listener{Listener: ln, Policy: policy}, nil
+}
+
+// forwarded sets the request's RemoteAddr to the client address given by the
+// Forwarded or X-Forwarded-For header, if the request came from a trusted
+// proxy. The port is left as the proxy's, which keeps addresses of clients
+// connected through the same proxy distinct.
+func (t trustedProxies) forwarded(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, port, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !t.contains(net.ParseIP(peer)) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		client := peer
+		hops := forwardedFor(r)
+		// Walk back along the chain of proxies until reaching one we don't
+		// trust, which is the client as far as we can tell.
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(hops[i])
+			if ip == nil {
+				break
+			}
+			client = ip.String()
+			if !t.contains(ip) {
+				break
+			}
+		}
+		r.RemoteAddr = net.JoinHostPort(client, port)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// forwardedFor returns the addresses the request was forwarded for, from the
+// Forwarded header if present or else X-Forwarded-For, nearest last.
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(key, "for") {
+						hops = append(hops, forwardedHost(strings.Trim(val, `"`)))
+					}
+				}
+			}
+		}
+		return hops
+	}
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// forwardedHost strips the port and IPv6 brackets from a Forwarded node.
+func forwardedHost(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+}
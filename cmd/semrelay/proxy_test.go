@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16", "2001:db8::1", "fd00::/8"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1/32", "192.168.0.0/16", "2001:db8::1/128", "fd00::/8"}, proxies.strings())
+	for ip, trusted := range map[string]bool{
+		// a bare IP only matches itself
+		"10.0.0.1":        true,
+		"10.0.0.2":        false,
+		"192.168.4.5":     true,
+		"192.169.0.1":     false,
+		"2001:db8::1":     true,
+		"2001:db8::2":     false,
+		"fd12:3456::1":    true,
+		"::ffff:10.0.0.1": true,
+	} {
+		assert.Equal(t, trusted, proxies.contains(net.ParseIP(ip)), ip)
+	}
+
+	for _, invalid := range []string{"10.0.0", "10.0.0.0/33", "example.com", "fd00::/129"} {
+		_, err := parseTrustedProxies([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+// remoteAddrAfter returns the RemoteAddr the handler sees for a request from
+// peer with the given headers.
+func remoteAddrAfter(proxies trustedProxies, peer string, header http.Header) string {
+	var seen string
+	h := proxies.forwarded(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.RemoteAddr
+	}))
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.RemoteAddr = peer
+	r.Header = header
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	return seen
+}
+
+func TestForwarded(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "2001:db8:ffff::/48"})
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		name   string
+		peer   string
+		header http.Header
+		want   string
+	}{
+		{
+			name:   "spoofed header from untrusted peer",
+			peer:   "203.0.113.9:5000",
+			header: http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:   "203.0.113.9:5000",
+		},
+		{
+			name:   "spoofed Forwarded from untrusted peer",
+			peer:   "203.0.113.9:5000",
+			header: http.Header{"Forwarded": {"for=198.51.100.1"}},
+			want:   "203.0.113.9:5000",
+		},
+		{
+			name:   "trusted proxy",
+			peer:   "10.1.2.3:5000",
+			header: http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:   "198.51.100.1:5000",
+		},
+		{
+			name:   "trusted proxy without header",
+			peer:   "10.1.2.3:5000",
+			header: http.Header{},
+			want:   "10.1.2.3:5000",
+		},
+		{
+			name:   "chain through trusted proxies",
+			peer:   "10.1.2.3:5000",
+			header: http.Header{"X-Forwarded-For": {"198.51.100.1, 192.168.1.1", "10.9.9.9"}},
+			want:   "198.51.100.1:5000",
+		},
+		{
+			name: "client spoofing the start of the chain",
+			peer: "10.1.2.3:5000",
+			// the untrusted hop nearest us is the client; anything it sent is
+			// ignored
+			header: http.Header{"X-Forwarded-For": {"1.1.1.1, 198.51.100.1, 10.9.9.9"}},
+			want:   "198.51.100.1:5000",
+		},
+		{
+			name:   "bare trusted IP doesn't trust its neighbours",
+			peer:   "10.1.2.3:5000",
+			header: http.Header{"X-Forwarded-For": {"198.51.100.1, 192.168.1.2"}},
+			want:   "192.168.1.2:5000",
+		},
+		{
+			name:   "all hops trusted",
+			peer:   "10.1.2.3:5000",
+			header: http.Header{"X-Forwarded-For": {"10.4.4.4, 192.168.1.1"}},
+			want:   "10.4.4.4:5000",
+		},
+		{
+			name:   "invalid hop stops the walk",
+			peer:   "10.1.2.3:5000",
+			header: http.Header{"X-Forwarded-For": {"198.51.100.1, garbage, 10.9.9.9"}},
+			want:   "10.9.9.9:5000",
+		},
+		{
+			name:   "Forwarded with quoted IPv6 and port",
+			peer:   "10.1.2.3:5000",
+			header: http.Header{"Forwarded": {`for="[2001:db8::1]:4711";proto=https;by=10.1.2.3`}},
+			want:   "[2001:db8::1]:5000",
+		},
+		{
+			name:   "Forwarded chain",
+			peer:   "10.1.2.3:5000",
+			header: http.Header{"Forwarded": {`for=198.51.100.1;proto=https, For="[2001:db8:ffff::5]"`, "for=192.168.1.1:80"}},
+			want:   "198.51.100.1:5000",
+		},
+		{
+			name: "Forwarded takes precedence",
+			peer: "10.1.2.3:5000",
+			header: http.Header{
+				"Forwarded":       {"for=198.51.100.1"},
+				"X-Forwarded-For": {"198.51.100.2"},
+			},
+			want: "198.51.100.1:5000",
+		},
+		{
+			name:   "obfuscated Forwarded node",
+			peer:   "10.1.2.3:5000",
+			header: http.Header{"Forwarded": {"for=_hidden"}},
+			want:   "10.1.2.3:5000",
+		},
+		{
+			name:   "IPv6 proxy",
+			peer:   "[2001:db8:ffff::1]:5000",
+			header: http.Header{"X-Forwarded-For": {"2001:db8:1::1"}},
+			want:   "[2001:db8:1::1]:5000",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, remoteAddrAfter(proxies, tc.peer, tc.header))
+		})
+	}
+}
+
+func TestForwardedNoProxies(t *testing.T) {
+	assert.Equal(t, "10.1.2.3:5000", remoteAddrAfter(nil, "10.1.2.3:5000",
+		http.Header{"X-Forwarded-For": {"198.51.100.1"}}))
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -12,42 +14,101 @@ import (
 	"github.com/csw/semrelay/relay"
 )
 
-func handleHook(d *relay.Dispatcher, w http.ResponseWriter, r *http.Request) {
-	curToken := r.URL.Query().Get("token")
-	if curToken != token {
-		log.WithField("token", curToken).Error("Wrong token for webhook message")
-		w.WriteHeader(400)
-		fmt.Fprintln(w, "nope")
+// recentMax is the most pipeline results remembered to detect redelivered
+// webhooks.
+const recentMax = 1024
+
+// recentHooks remembers recently received pipeline results, since Semaphore
+// may deliver the same webhook more than once.
+type recentHooks struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+	// keys are in the order they were received.
+	keys []string
+}
+
+var recent = newRecentHooks()
+
+func newRecentHooks() *recentHooks {
+	return &recentHooks{seen: make(map[string]time.Time)}
+}
+
+// redelivered reports whether the key was received in the window before now,
+// remembering it if not.
+func (r *recentHooks) redelivered(key string, now time.Time, window time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.keys) > 0 && now.Sub(r.seen[r.keys[0]]) >= window {
+		delete(r.seen, r.keys[0])
+		r.keys = r.keys[1:]
+	}
+	if _, found := r.seen[key]; found {
+		return true
+	}
+	if len(r.keys) >= recentMax {
+		delete(r.seen, r.keys[0])
+		r.keys = r.keys[1:]
+	}
+	r.seen[key] = now
+	r.keys = append(r.keys, key)
+	return false
+}
+
+func handleHook(b relay.Broker, w http.ResponseWriter, r *http.Request) {
+	hooksReceived.Inc()
+	cfg := currentConfig()
+	if r.URL.Query().Get("token") != cfg.Token {
+		log.WithField("remote", r.RemoteAddr).Error("Wrong token for webhook message")
+		rejectHook(w, r, "token", 400)
 		return
 	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.WithError(err).Error("Read error on webhook message")
-		w.WriteHeader(500)
-		fmt.Fprintln(w, "nope")
+		rejectHook(w, r, "read", 500)
 		return
 	}
 	log.Debugf("Got webhook notification: %s", body)
 	var n semrelay.Notification
 	if err := json.Unmarshal(body, &n); err != nil {
 		log.WithError(err).Error("Failed to parse webhook message")
-		w.WriteHeader(400)
-		fmt.Fprintln(w, "nope")
+		rejectHook(w, r, "malformed", 400)
 		return
 	}
 	user := n.Revision.Sender.Login
 	if user == "" {
 		log.Error("No user in webhook message")
-		w.WriteHeader(400)
-		fmt.Fprintln(w, "nope")
+		rejectHook(w, r, "no_user", 400)
 		return
 	}
-	log.WithFields(log.Fields{
+	hlog := log.WithFields(log.Fields{
 		"user":       user,
 		"repository": n.Repository.Slug,
 		"done_at":    n.Pipeline.DoneAt,
 		"pipeline":   n.Pipeline.Id,
-	}).Info("Received build notification")
-	d.Dispatch(user, body)
+	})
+	if cfg.HookDedupWindow > 0 && n.Pipeline.Id != "" &&
+		recent.redelivered(n.Pipeline.Id+"/"+n.Pipeline.Result, time.Now(), cfg.HookDedupWindow) {
+		hlog.Info("Ignoring redelivered build notification")
+		hooksDeduplicated.Inc()
+		audit("hook", log.Fields{"result": "duplicate", "remote": remoteIP(r),
+			"pipeline": n.Pipeline.Id})
+		fmt.Fprintln(w, "Roger")
+		return
+	}
+	recipients := cfg.recipients(&n)
+	hlog.WithField("recipients", recipients).Info("Received build notification")
+	audit("hook", log.Fields{"result": "accepted", "remote": remoteIP(r),
+		"pipeline": n.Pipeline.Id, "recipients": recipients})
+	for _, recipient := range recipients {
+		b.Dispatch(recipient, body)
+	}
 	fmt.Fprintln(w, "Roger")
 }
+
+func rejectHook(w http.ResponseWriter, r *http.Request, reason string, status int) {
+	hooksRejected.WithLabelValues(reason).Inc()
+	audit("hook", log.Fields{"result": "rejected", "reason": reason, "remote": remoteIP(r)})
+	w.WriteHeader(status)
+	fmt.Fprintln(w, "nope")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csw/semrelay/internal"
+	"github.com/csw/semrelay/relay"
+)
+
+func TestRecentHooks(t *testing.T) {
+	r := newRecentHooks()
+	now := time.Now()
+	assert.False(t, r.redelivered("p1/passed", now, time.Minute))
+	assert.True(t, r.redelivered("p1/passed", now.Add(30*time.Second), time.Minute))
+	assert.False(t, r.redelivered("p1/failed", now.Add(30*time.Second), time.Minute))
+	// forgotten after the window
+	assert.False(t, r.redelivered("p1/passed", now.Add(time.Minute), time.Minute))
+	assert.True(t, r.redelivered("p1/passed", now.Add(90*time.Second), time.Minute))
+	assert.Len(t, r.keys, 1)
+}
+
+func TestRecentHooksBounded(t *testing.T) {
+	r := newRecentHooks()
+	now := time.Now()
+	for i := 0; i < recentMax+10; i++ {
+		assert.False(t, r.redelivered(fmt.Sprintf("p%d/passed", i), now, time.Hour))
+	}
+	assert.Len(t, r.keys, recentMax)
+	assert.Len(t, r.seen, recentMax)
+	// the oldest are forgotten
+	assert.False(t, r.redelivered("p0/passed", now, time.Hour))
+	assert.True(t, r.redelivered(fmt.Sprintf("p%d/passed", recentMax+9), now, time.Hour))
+}
+
+func postHook(b relay.Broker, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/hook?token=token", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	handleHook(b, w, r)
+	return w
+}
+
+func TestHandleHookRedelivery(t *testing.T) {
+	defer func() { recent = newRecentHooks() }()
+	d := relay.NewDispatcher()
+	go d.Run()
+	client := newFakeClient()
+	d.Register("csw", client)
+	<-client.helloCh
+
+	applyConfig(&config{Token: "token", LogLevel: log.GetLevel(), HookDedupWindow: time.Minute})
+	recent = newRecentHooks()
+	deduplicated := testutil.ToFloat64(hooksDeduplicated)
+	require.Equal(t, http.StatusOK, postHook(d, internal.ExampleSuccess).Code)
+	require.Equal(t, http.StatusOK, postHook(d, internal.ExampleSuccess).Code)
+	require.Equal(t, http.StatusOK, postHook(d, internal.ExampleFailure).Code)
+	assert.Equal(t, deduplicated+1, testutil.ToFloat64(hooksDeduplicated))
+	<-client.msgCh
+	<-client.msgCh
+	select {
+	case <-client.msgCh:
+		t.Fatal("redelivered webhook was dispatched")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// disabled
+	applyConfig(&config{Token: "token", LogLevel: log.GetLevel()})
+	require.Equal(t, http.StatusOK, postHook(d, internal.ExampleSuccess).Code)
+	<-client.msgCh
+	assert.Equal(t, deduplicated+1, testutil.ToFloat64(hooksDeduplicated))
+}
@@ -1,68 +1,145 @@
 package main
 
 import (
+	"context"
+	"net"
 	"net/http"
 	"os"
-	"time"
+	"strings"
 
-	"github.com/caddyserver/certmagic"
+	"github.com/go-redis/redis/v8"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 
-	internal "github.com/csw/semrelay/internal"
 	"github.com/csw/semrelay/relay"
 )
 
-var password string
-var token string
+var domains []string
+var httpOnly bool
+
+// redisBroker is set when sharing notifications with other instances.
+var redisBroker *relay.RedisBroker
 
 func main() {
-	domain := os.Getenv("DOMAIN")
-	if domain == "" {
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		if err := runAdmin(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := parseConfig(); err != nil {
+		log.WithError(err).Fatal("Error reading configuration")
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		log.WithError(err).Fatal("Configuration error")
+	}
+	applyConfig(cfg)
+	go reloadOnHangup()
+	openAuditLog()
+	domains = splitList(viper.GetStringSlice("domain"))
+	httpOnly = viper.GetBool("http_only")
+	if certFile := viper.GetString("cert_file"); certFile != "" && !httpOnly {
+		keyFile := viper.GetString("key_file")
+		if keyFile == "" {
+			log.Fatal("Must specify KEY_FILE with CERT_FILE")
+		}
+		if staticCert, err = loadCertFiles(certFile, keyFile); err != nil {
+			log.WithError(err).Fatal("Failed to load certificate")
+		}
+	} else if len(domains) == 0 {
 		log.Fatal("Must specify DOMAIN")
 	}
-	password = os.Getenv("PASSWORD")
-	if password == "" {
-		log.Fatal("Must specify PASSWORD")
+	if caFile := viper.GetString("client_ca"); caFile != "" {
+		if httpOnly {
+			log.Fatal("CLIENT_CA requires HTTPS")
+		}
+		if clientCAs, err = loadCertPool(caFile); err != nil {
+			log.WithError(err).Fatal("Failed to load client CA")
+		}
+	}
+	if err := configureACME(); err != nil {
+		log.WithError(err).Fatal("ACME configuration error")
+	}
+	if proxies, err = parseTrustedProxies(splitList(viper.GetStringSlice("trusted_proxies"))); err != nil {
+		log.WithError(err).Fatal("Configuration error")
 	}
-	token = os.Getenv("TOKEN")
-	if token == "" {
-		log.Fatal("Must specify TOKEN")
+	proxyProtocol := viper.GetBool("proxy_protocol")
+	if proxyProtocol && len(proxies) == 0 {
+		log.Fatal("PROXY_PROTOCOL requires TRUSTED_PROXIES")
 	}
-	certmagic.DefaultACME.Email = os.Getenv("EMAIL")
-	if os.Getenv("STAGING") != "" {
-		certmagic.DefaultACME.CA = certmagic.LetsEncryptStagingCA
+	basePath := strings.TrimSuffix(viper.GetString("base_path"), "/")
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		log.Fatal("BASE_PATH must start with /")
 	}
-	if os.Getenv("VERBOSE") != "" {
-		log.SetLevel(log.DebugLevel)
+	httpAddr := viper.GetString("http_addr")
+	if httpAddr == "" {
+		httpAddr = ":" + viper.GetString("port")
+	}
+	if addr := viper.GetString("metrics_addr"); addr != "" {
+		go serveMetrics(addr)
 	}
 	disp := relay.NewDispatcher()
 	go disp.Run()
+	var broker relay.Broker = disp
+	if redisURL := viper.GetString("redis_url"); redisURL != "" {
+		opts, err := redis.ParseURL(redisURL)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid REDIS_URL")
+		}
+		redisBroker = relay.NewRedisBroker(disp, redis.NewClient(opts), viper.GetString("redis_channel"))
+		go func() {
+			if err := redisBroker.Run(context.Background()); err != nil {
+				log.WithError(err).Fatal("Redis broker failed")
+			}
+		}()
+		broker = redisBroker
+	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/hook", func(w http.ResponseWriter, r *http.Request) {
-		handleHook(disp, w, r)
+		handleHook(broker, w, r)
 	})
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		serveWs(disp, w, r)
+		serveWs(disp, broker, w, r)
 	})
-	if user := os.Getenv("TEST"); user != "" {
-		go func() {
-			for {
-				time.Sleep(15 * time.Second)
-				disp.Dispatch(user, internal.ExampleSuccess)
-			}
-		}()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		handleReadyz(disp, w, r)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		handleStatus(disp, w, r)
+	})
+	adminHandler := func(w http.ResponseWriter, r *http.Request) {
+		handleAdmin(disp, w, r)
 	}
-	var err error
-	if os.Getenv("HTTP_ONLY") != "" {
-		port := "80"
-		if portspec := os.Getenv("PORT"); portspec != "" {
-			port = portspec
-		}
-		err = http.ListenAndServe(":"+port, mux)
+	mux.HandleFunc(adminPrefix, adminHandler)
+	mux.HandleFunc(adminPrefix+"/", adminHandler)
+	mux.HandleFunc(adminTestPath, func(w http.ResponseWriter, r *http.Request) {
+		handleAdminTest(disp, broker, w, r)
+	})
+	var handler http.Handler = mux
+	if basePath != "" {
+		root := http.NewServeMux()
+		root.Handle(basePath+"/", http.StripPrefix(basePath, mux))
+		handler = root
+	}
+	if len(proxies) > 0 {
+		handler = proxies.forwarded(handler)
+	}
+	httpLn, err := listen(httpAddr, proxyProtocol)
+	if err != nil {
+		log.Fatal("Listen: ", err)
+	}
+	if httpOnly {
+		err = http.Serve(httpLn, handler)
 	} else {
-		err = certmagic.HTTPS([]string{domain}, mux)
+		var httpsLn net.Listener
+		if httpsLn, err = listen(viper.GetString("https_addr"), proxyProtocol); err != nil {
+			log.Fatal("Listen: ", err)
+		}
+		err = serveTLS(httpLn, httpsLn, domains, handler)
 	}
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		log.Fatal("Serve: ", err)
 	}
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/csw/semrelay/relay"
+)
+
+// version may be set at build time with -ldflags "-X main.version=...".
+var version string
+
+var startTime = time.Now()
+
+// readyTimeout bounds each readiness check, including waiting for the
+// dispatcher to respond.
+const readyTimeout = 2 * time.Second
+
+func getVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// checkAdmin checks that the request carries the admin token as a bearer
+// token, writing an error response if not.
+func checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	adminToken := currentConfig().AdminToken
+	if adminToken == "" {
+		http.Error(w, "admin API disabled", http.StatusNotFound)
+		return false
+	}
+	supplied := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(supplied), []byte(adminToken)) != 1 {
+		log.WithField("remote", r.RemoteAddr).Error("Wrong admin token")
+		audit("admin_auth", log.Fields{"result": "rejected", "remote": remoteIP(r),
+			"path": r.URL.Path})
+		http.Error(w, "nope", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("Error writing response")
+	}
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func handleReadyz(d *relay.Dispatcher, w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	if err := checkReady(ctx, d); err != nil {
+		log.WithError(err).Warn("Readiness check failed")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func checkReady(ctx context.Context, d *relay.Dispatcher) error {
+	if _, err := d.Users(ctx); err != nil {
+		return fmt.Errorf("dispatcher not responding: %w", err)
+	}
+	if redisBroker != nil {
+		if err := redisBroker.Ping(ctx); err != nil {
+			return fmt.Errorf("redis not reachable: %w", err)
+		}
+	}
+	if httpOnly {
+		return nil
+	}
+	if staticCert != nil {
+		return staticCert.check()
+	}
+	for _, domain := range domains {
+		if err := checkCertificate(domain); err != nil {
+			return err
+		}
+	}
+	return checkStorage()
+}
+
+// checkCertificate checks that a valid certificate for the domain has been
+// obtained, without loading it.
+func checkCertificate(domain string) error {
+	if certCache == nil {
+		return fmt.Errorf("certificate for %s not loaded", domain)
+	}
+	now := time.Now()
+	for _, cert := range certCache.AllMatchingCertificates(domain) {
+		if cert.Leaf != nil && now.Before(cert.Leaf.NotAfter) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no valid certificate for %s loaded", domain)
+}
+
+// storageCheckInterval is how long the result of checking certmagic's storage
+// is reused, so that frequent probes don't write to it each time.
+const storageCheckInterval = 5 * time.Minute
+
+var storageCheck struct {
+	sync.Mutex
+	at  time.Time
+	err error
+}
+
+// checkStorage checks that certmagic's storage is writable, so certificates
+// can be renewed.
+func checkStorage() error {
+	storage := certmagic.Default.Storage
+	if storage == nil {
+		return nil
+	}
+	storageCheck.Lock()
+	defer storageCheck.Unlock()
+	if !storageCheck.at.IsZero() && time.Since(storageCheck.at) < storageCheckInterval {
+		return storageCheck.err
+	}
+	storageCheck.at = time.Now()
+	storageCheck.err = nil
+	const key = "semrelay_readyz"
+	if err := storage.Store(key, []byte(time.Now().Format(time.RFC3339))); err != nil {
+		storageCheck.err = fmt.Errorf("storage not writable: %w", err)
+	} else if err := storage.Delete(key); err != nil {
+		storageCheck.err = fmt.Errorf("storage not writable: %w", err)
+	}
+	return storageCheck.err
+}
+
+type serverStatus struct {
+	Version string             `json:"version"`
+	Started time.Time          `json:"started"`
+	Uptime  string             `json:"uptime"`
+	Users   []relay.UserStatus `json:"users"`
+}
+
+func handleStatus(d *relay.Dispatcher, w http.ResponseWriter, r *http.Request) {
+	if !checkAdmin(w, r) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	users, err := d.Status(ctx)
+	if err != nil {
+		log.WithError(err).Error("Failed to get status")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, serverStatus{
+		Version: getVersion(),
+		Started: startTime,
+		Uptime:  time.Since(startTime).Round(time.Second).String(),
+		Users:   users,
+	})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// certPollInterval is how often static certificate files are checked for
+// changes.
+const certPollInterval = 30 * time.Second
+
+// clientCAs is set when clients must authenticate to /ws with a
+// certificate issued by one of these CAs.
+var clientCAs *x509.CertPool
+
+// staticCert is set when serving a certificate from files instead of
+// acquiring one with ACME.
+var staticCert *certFiles
+
+// certFiles serves a certificate and key loaded from files, reloading them
+// when they change.
+type certFiles struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func loadCertFiles(certFile, keyFile string) (*certFiles, error) {
+	c := &certFiles{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the certificate and key, keeping the current ones if they
+// can't be loaded.
+func (c *certFiles) reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mu.Unlock()
+	log.WithFields(log.Fields{
+		"subject": cert.Leaf.Subject.CommonName,
+		"expires": cert.Leaf.NotAfter,
+	}).Info("Loaded TLS certificate")
+	return nil
+}
+
+func (c *certFiles) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// watch polls the files and reloads them when either is modified.
+func (c *certFiles) watch() {
+	for range time.Tick(certPollInterval) {
+		modTime, err := c.latestModTime()
+		if err != nil {
+			log.WithError(err).Error("Failed to check certificate files")
+			continue
+		}
+		c.mu.RLock()
+		changed := !modTime.Equal(c.modTime)
+		c.mu.RUnlock()
+		if changed {
+			if err := c.reload(); err != nil {
+				log.WithError(err).Error("Failed to reload certificate, keeping current one")
+			}
+		}
+	}
+}
+
+func (c *certFiles) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+func (c *certFiles) check() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if time.Now().After(c.cert.Leaf.NotAfter) {
+		return errors.New("certificate expired")
+	}
+	return nil
+}
+
+// configureACME applies the ACME settings to certmagic's defaults.
+func configureACME() error {
+	certmagic.DefaultACME.Email = viper.GetString("email")
+	certmagic.DefaultACME.Agreed = true
+	if viper.GetBool("staging") {
+		certmagic.DefaultACME.CA = certmagic.LetsEncryptStagingCA
+	}
+	if ca := viper.GetString("acme_ca"); ca != "" {
+		certmagic.DefaultACME.CA = ca
+	}
+	if rootFile := viper.GetString("acme_ca_root"); rootFile != "" {
+		pool, err := loadCertPool(rootFile)
+		if err != nil {
+			return err
+		}
+		certmagic.DefaultACME.TrustedRoots = pool
+	}
+	return nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// clientCertUser returns the user named by the common name of the request's
+// verified client certificate, or "" if there isn't one.
+func clientCertUser(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// certCache holds the certificates acquired with ACME, so that readiness
+// checks can inspect them.
+var certCache *certmagic.Cache
+
+// serveTLS serves the handler over HTTPS on httpsLn, using either static
+// certificate files or certificates acquired with ACME for domains. Plain
+// HTTP requests to httpLn are redirected to HTTPS, after answering any ACME
+// HTTP challenges.
+func serveTLS(httpLn, httpsLn net.Listener, domains []string, handler http.Handler) error {
+	var tlsConfig *tls.Config
+	redirect := httpsRedirect(httpsLn.Addr().String())
+	httpHandler := redirect
+	if staticCert != nil {
+		go staticCert.watch()
+		tlsConfig = &tls.Config{GetCertificate: staticCert.getCertificate}
+	} else {
+		certCache = certmagic.NewCache(certmagic.CacheOptions{
+			GetConfigForCert: func(certmagic.Certificate) (*certmagic.Config, error) {
+				return certmagic.New(certCache, certmagic.Default), nil
+			},
+		})
+		cfg := certmagic.New(certCache, certmagic.Default)
+		if err := cfg.ManageSync(context.Background(), domains); err != nil {
+			return err
+		}
+		tlsConfig = cfg.TLSConfig()
+		if am, ok := cfg.Issuers[0].(*certmagic.ACMEManager); ok {
+			httpHandler = am.HTTPChallengeHandler(redirect)
+		}
+	}
+	tlsConfig.NextProtos = append([]string{"h2", "http/1.1"}, tlsConfig.NextProtos...)
+	if clientCAs != nil {
+		// Semaphore can't present a certificate, so only /ws requires one.
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	httpServer := &http.Server{
+		Handler:           httpHandler,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       5 * time.Second,
+		WriteTimeout:      5 * time.Second,
+		IdleTimeout:       5 * time.Second,
+	}
+	httpsServer := &http.Server{
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      2 * time.Minute,
+		IdleTimeout:       5 * time.Minute,
+	}
+	go func() {
+		log.WithField("addr", httpLn.Addr()).Info("Serving HTTP redirects")
+		if err := httpServer.Serve(httpLn); err != nil {
+			log.WithError(err).Error("HTTP server failed")
+		}
+	}()
+	log.WithFields(log.Fields{"addr": httpsLn.Addr(), "domains": domains}).Info("Serving HTTPS")
+	return httpsServer.ServeTLS(httpsLn, "", "")
+}
+
+// httpsRedirect redirects requests to the same host on the HTTPS port.
+func httpsRedirect(httpsAddr string) http.Handler {
+	_, port, err := net.SplitHostPort(httpsAddr)
+	if err != nil || port == "443" {
+		port = ""
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+		w.Header().Set("Connection", "close")
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csw/semrelay"
+	"github.com/csw/semrelay/relay"
+)
+
+// testCA issues client certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns a client certificate for the common name.
+func (ca *testCA) issue(t *testing.T, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startCertServer serves /ws over TLS, requiring client certificates from
+// the CA.
+func startCertServer(t *testing.T, ca *testCA) (*relay.Dispatcher, string) {
+	applyConfig(&config{Password: "password", LogLevel: log.GetLevel()})
+	old := clientCAs
+	clientCAs = ca.pool()
+	t.Cleanup(func() { clientCAs = old })
+	d := relay.NewDispatcher()
+	go d.Run()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWs(d, d, w, r)
+	}))
+	srv.TLS = &tls.Config{
+		ClientCAs:  clientCAs,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return d, "wss" + strings.TrimPrefix(srv.URL, "https") + "/ws"
+}
+
+func dialWithCert(url string, certs ...tls.Certificate) (*websocket.Conn, *http.Response, error) {
+	dialer := websocket.Dialer{
+		TLSClientConfig: &tls.Config{
+			// the server's certificate is httptest's
+			InsecureSkipVerify: true,
+			Certificates:       certs,
+		},
+		HandshakeTimeout: 5 * time.Second,
+	}
+	return dialer.Dial(url, nil)
+}
+
+// register sends a registration, returning the server's reply.
+func register(t *testing.T, conn *websocket.Conn, user, password string) (semrelay.Message, error) {
+	require.NoError(t, conn.WriteJSON(semrelay.MakeRegistration(user, password)))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	var msg semrelay.Message
+	err := conn.ReadJSON(&msg)
+	return msg, err
+}
+
+func TestClientCertRequired(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	_, url := startCertServer(t, ca)
+	failures := testutil.ToFloat64(registrationFailures.WithLabelValues("client_cert"))
+	_, res, err := dialWithCert(url)
+	require.Error(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	assert.Equal(t, failures+1, testutil.ToFloat64(registrationFailures.WithLabelValues("client_cert")))
+
+	// a certificate from another CA doesn't get past the TLS handshake
+	other := newTestCA(t, "other CA")
+	_, _, err = dialWithCert(url, other.issue(t, "alice"))
+	assert.Error(t, err)
+}
+
+func TestClientCertUserMismatch(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	_, url := startCertServer(t, ca)
+	failures := testutil.ToFloat64(registrationFailures.WithLabelValues("cert_user"))
+	conn, _, err := dialWithCert(url, ca.issue(t, "alice"))
+	require.NoError(t, err)
+	defer conn.Close()
+	// even with the right password
+	_, err = register(t, conn, "bob", "password")
+	assert.Error(t, err, "registration should be rejected")
+	assert.Equal(t, failures+1, testutil.ToFloat64(registrationFailures.WithLabelValues("cert_user")))
+}
+
+func TestClientCertIgnoresPassword(t *testing.T) {
+	ca := newTestCA(t, "test CA")
+	d, url := startCertServer(t, ca)
+	for _, user := range []string{"alice", ""} {
+		conn, _, err := dialWithCert(url, ca.issue(t, "alice"))
+		require.NoError(t, err)
+		msg, err := register(t, conn, user, "wrong")
+		require.NoError(t, err, "user %q", user)
+		assert.Equal(t, semrelay.HelloMsg, msg.Type)
+		conn.Close()
+	}
+	users, err := d.Users(context.Background())
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "alice", users[0].Name)
+}
@@ -1,6 +1,6 @@
 module github.com/csw/semrelay
 
-go 1.17
+go 1.18
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -13,7 +13,6 @@ require (
 	github.com/miekg/dns v1.1.43 // indirect
 	github.com/mitchellh/mapstructure v1.4.2 // indirect
 	github.com/pelletier/go-toml v1.9.4 // indirect
-	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/spf13/afero v1.6.0 // indirect
 	github.com/spf13/cast v1.4.1 // indirect
@@ -33,12 +32,31 @@ require (
 
 require (
 	github.com/adrg/xdg v0.4.0
+	github.com/alicebob/miniredis/v2 v2.30.4
 	github.com/caddyserver/certmagic v0.15.2
 	github.com/esiqveland/notify v0.11.0
+	github.com/go-redis/redis/v8 v8.11.5
 	github.com/godbus/dbus/v5 v5.0.6
 	github.com/gorilla/websocket v1.4.2
+	github.com/pires/go-proxyproto v0.6.2
+	github.com/prometheus/client_golang v1.12.2
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/viper v1.9.0
 	github.com/stretchr/testify v1.7.0
-	golang.org/x/sys v0.0.0-20211025201205-69cdffdb9359
+	golang.org/x/sys v0.0.0-20220114195835-da31bd327af9
+	gopkg.in/natefinch/lumberjack.v2 v2.0.0
+)
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.32.1 // indirect
+	github.com/prometheus/procfs v0.7.3 // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
+	google.golang.org/protobuf v1.27.1 // indirect
 )
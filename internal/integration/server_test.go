@@ -25,6 +25,7 @@ const (
 	testUser     = "csw"
 	testPassword = "password"
 	testToken    = "token"
+	testAdmin    = "admin"
 )
 
 func TestBasic(t *testing.T) {
@@ -68,6 +69,116 @@ func TestDifferentUser(t *testing.T) {
 	require.True(t, errors.Is(err, net.ErrClosed) || err == io.EOF, "unexpected error: %v", err)
 }
 
+func TestHealth(t *testing.T) {
+	for _, path := range []string{"/healthz", "/readyz"} {
+		res, err := http.Get(serverUrl(path))
+		require.NoError(t, err)
+		require.Equal(t, 200, res.StatusCode, path)
+		require.NoError(t, res.Body.Close())
+	}
+}
+
+func TestStatus(t *testing.T) {
+	c1 := wsConn(t, testUser, testPassword)
+	defer c1.Close()
+	res, err := http.Get(serverUrl("/status"))
+	require.NoError(t, err)
+	require.Equal(t, 401, res.StatusCode)
+	require.NoError(t, res.Body.Close())
+
+	req, err := http.NewRequest("GET", serverUrl("/status"), nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdmin)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, 200, res.StatusCode)
+	var status struct {
+		Users []struct {
+			Name    string   `json:"name"`
+			Clients []string `json:"clients"`
+		} `json:"users"`
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&status))
+	found := false
+	for _, u := range status.Users {
+		if u.Name == testUser {
+			found = len(u.Clients) > 0
+		}
+	}
+	require.True(t, found, "user not connected: %+v", status)
+}
+
+func TestAdmin(t *testing.T) {
+	conn := wsConn(t, "admin_test", testPassword)
+	defer conn.Close()
+	adminRequest(t, "POST", "/admin/test?user=admin_test", nil)
+	var msg semrelay.Message
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.Equal(t, semrelay.NotificationMsg, msg.Type)
+
+	var dump struct {
+		InFlight []struct {
+			Id string `json:"id"`
+		} `json:"in_flight"`
+	}
+	res := adminRequest(t, "GET", "/admin/users/admin_test/queue", nil)
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&dump))
+	require.Len(t, dump.InFlight, 1)
+	require.Equal(t, fmt.Sprint(msg.Id), dump.InFlight[0].Id)
+
+	adminRequest(t, "DELETE", "/admin/users/admin_test/notifications/"+dump.InFlight[0].Id, nil)
+	res = adminRequest(t, "GET", "/admin/users/admin_test/queue", nil)
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&dump))
+	require.Empty(t, dump.InFlight)
+
+	var users []struct {
+		Name    string   `json:"name"`
+		Clients []string `json:"clients"`
+	}
+	res = adminRequest(t, "GET", "/admin/users", nil)
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&users))
+	var clients []string
+	for _, u := range users {
+		if u.Name == "admin_test" {
+			clients = u.Clients
+		}
+	}
+	require.Len(t, clients, 1)
+	adminRequest(t, "DELETE", "/admin/users/admin_test/clients/"+clients[0], nil)
+	_, _, err := conn.ReadMessage()
+	require.Error(t, err)
+}
+
+func TestTestNotification(t *testing.T) {
+	conn := wsConn(t, "test_user", testPassword)
+	defer conn.Close()
+	adminRequest(t, "POST", "/admin/test?user=test_user&kind=failure", nil)
+	var msg semrelay.Message
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.Equal(t, semrelay.NotificationMsg, msg.Type)
+	require.True(t, msg.Test)
+	var n semrelay.Notification
+	require.NoError(t, json.Unmarshal(msg.Payload, &n))
+	require.True(t, n.Failed())
+	require.NoError(t, conn.WriteJSON(semrelay.MakeAck(msg.Id)))
+}
+
+func adminRequest(t *testing.T, method, path string, body []byte) *http.Response {
+	req, err := http.NewRequest(method, serverUrl(path), bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testAdmin)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { res.Body.Close() })
+	require.Equal(t, 200, res.StatusCode, "%s %s", method, path)
+	return res
+}
+
+func serverUrl(path string) string {
+	return fmt.Sprintf("http://localhost:%s%s", os.Getenv("TARGET_PORT"), path)
+}
+
 func wsConn(t *testing.T, user, password string) *websocket.Conn {
 	wsUrl := fmt.Sprintf("ws://localhost:%s/ws", os.Getenv("TARGET_PORT"))
 	conn, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
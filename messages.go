@@ -7,12 +7,16 @@ const (
 	NotificationMsg = "notification"
 	AckMsg          = "ack"
 	HelloMsg        = "hello"
+	DismissMsg      = "dismiss"
 )
 
 type Message struct {
 	Type    string          `json:"type"`
 	Id      uint64          `json:"id"`
 	Payload json.RawMessage `json:"payload"`
+	// Test marks a notification sent to test the relay, rather than for a
+	// real build.
+	Test bool `json:"test,omitempty"`
 }
 
 func MakeRegistration(user, password string) *Message {
@@ -41,3 +45,9 @@ func MakeNotification(id uint64, payload json.RawMessage) *Message {
 func MakeAck(id uint64) Message {
 	return Message{Type: AckMsg, Id: id}
 }
+
+// MakeDismiss builds a message indicating that the notification with the given
+// id was clicked or closed on one client, and should be closed on the others.
+func MakeDismiss(id uint64) Message {
+	return Message{Type: DismissMsg, Id: id}
+}
@@ -1,60 +1,219 @@
 package semrelay
 
+import (
+	"fmt"
+	"time"
+)
+
+// Pipeline, block, and job results reported by Semaphore.
+const (
+	ResultPassed   = "passed"
+	ResultFailed   = "failed"
+	ResultStopped  = "stopped"
+	ResultCanceled = "canceled"
+)
+
 // Notification is the JSON object sent by Semaphore describing the build
 // results. See https://docs.semaphoreci.com/essentials/webhook-notifications/.
-// Note that not all its fields are mapped.
+//
+// Timestamps are kept as the RFC 3339 strings Semaphore sends, so that an
+// empty or malformed timestamp doesn't prevent relaying the notification; use
+// the helper methods to interpret them.
 type Notification struct {
-	Version string `json:"version"`
-	Project struct {
-		Name string `json:"name"`
-	} `json:"project"`
-	Organization struct {
-		Name string `json:"name"`
-	}
-	Repository struct {
-		Url  string `json:"url"`
-		Slug string `json:"slug"`
-	} `json:"repository"`
-	Revision struct {
-		Tag    string `json:"tag"`
-		Sender struct {
-			Login string `json:"login"`
-		} `json:"sender"`
-		ReferenceType string `json:"reference_type"`
-		Reference     string `json:"reference"`
-		PullRequest   string `json:"pull_request"`
-		CommitSHA     string `json:"commit_sha"`
-		CommitMessage string `json:"commit_message"`
-		Branch        struct {
-			Name        string `json:"name"`
-			CommitRange string `json:"commit_range"`
-		} `json:"branch"`
-	} `json:"revision"`
-	Pipeline struct {
-		Id           string `json:"id"`
-		State        string `json:"state"`
-		RunningAt    string `json:"running_at"`
-		DoneAt       string `json:"done_at"`
-		ResultReason string `json:"result_reason"`
-		Result       string `json:"result"`
-		YamlFileName string `json:"yaml_file_name"`
-	} `json:"pipeline"`
-	Workflow struct {
-		Id                string `json:"id"`
-		CreatedAt         string `json:"created_at"`
-		InitialPipelineId string `json:"initial_pipeline_id"`
-	} `json:"workflow"`
-	Blocks []*struct {
-		Name         string `json:"name"`
-		Result       string `json:"result"`
-		ResultReason string `json:"result_reason"`
-		State        string `json:"state"`
-		Jobs         []*struct {
-			Id     string `json:"id"`
-			Index  int    `json:"index"`
-			Name   string `json:"name"`
-			Result string `json:"result"`
-			Status string `json:"status"`
-		} `json:"jobs"`
-	} `json:"blocks"`
+	Version      string       `json:"version"`
+	Organization Organization `json:"organization"`
+	Project      Project      `json:"project"`
+	Repository   Repository   `json:"repository"`
+	Revision     Revision     `json:"revision"`
+	Pipeline     Pipeline     `json:"pipeline"`
+	Workflow     Workflow     `json:"workflow"`
+	Blocks       []*Block     `json:"blocks"`
+}
+
+type Organization struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type Project struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type Repository struct {
+	Url  string `json:"url"`
+	Slug string `json:"slug"`
+}
+
+type Revision struct {
+	// Tag is set when ReferenceType is "tag".
+	Tag    *Tag   `json:"tag"`
+	Sender Sender `json:"sender"`
+	// ReferenceType is "branch", "tag", or "pull_request".
+	ReferenceType string `json:"reference_type"`
+	Reference     string `json:"reference"`
+	// PullRequest is set when ReferenceType is "pull_request".
+	PullRequest   *PullRequest `json:"pull_request"`
+	CommitSHA     string       `json:"commit_sha"`
+	CommitMessage string       `json:"commit_message"`
+	Branch        Branch       `json:"branch"`
+}
+
+type Tag struct {
+	Name string `json:"name"`
+}
+
+type Sender struct {
+	Login     string `json:"login"`
+	Email     string `json:"email"`
+	AvatarUrl string `json:"avatar_url"`
+}
+
+type Branch struct {
+	Name        string `json:"name"`
+	CommitRange string `json:"commit_range"`
+}
+
+type PullRequest struct {
+	Number       string `json:"number"`
+	Name         string `json:"name"`
+	BranchName   string `json:"branch_name"`
+	HeadRepoSlug string `json:"head_repo_slug"`
+	HeadSHA      string `json:"head_sha"`
+	CommitRange  string `json:"commit_range"`
+}
+
+type Pipeline struct {
+	Id               string `json:"id"`
+	Name             string `json:"name"`
+	State            string `json:"state"`
+	Result           string `json:"result"`
+	ResultReason     string `json:"result_reason"`
+	ErrorDescription string `json:"error_description"`
+	YamlFileName     string `json:"yaml_file_name"`
+	WorkingDirectory string `json:"working_directory"`
+	CreatedAt        string `json:"created_at"`
+	PendingAt        string `json:"pending_at"`
+	QueuingAt        string `json:"queuing_at"`
+	RunningAt        string `json:"running_at"`
+	StoppingAt       string `json:"stopping_at"`
+	DoneAt           string `json:"done_at"`
+}
+
+type Workflow struct {
+	Id                string `json:"id"`
+	CreatedAt         string `json:"created_at"`
+	InitialPipelineId string `json:"initial_pipeline_id"`
+}
+
+type Block struct {
+	Name         string `json:"name"`
+	Result       string `json:"result"`
+	ResultReason string `json:"result_reason"`
+	State        string `json:"state"`
+	Jobs         []*Job `json:"jobs"`
+}
+
+type Job struct {
+	Id     string `json:"id"`
+	Index  int    `json:"index"`
+	Name   string `json:"name"`
+	Result string `json:"result"`
+	Status string `json:"status"`
+}
+
+// Failed reports whether the pipeline failed.
+func (n *Notification) Failed() bool {
+	return n.Pipeline.Result == ResultFailed
+}
+
+// IsPromotion reports whether the pipeline is a promotion rather than the
+// workflow's initial pipeline.
+func (n *Notification) IsPromotion() bool {
+	return n.Pipeline.Id != n.Workflow.InitialPipelineId
+}
+
+// Duration returns how long the pipeline ran.
+func (n *Notification) Duration() (time.Duration, error) {
+	return between(n.Pipeline.RunningAt, n.Pipeline.DoneAt)
+}
+
+// QueueTime returns how long the pipeline waited between being created and
+// starting to run.
+func (n *Notification) QueueTime() (time.Duration, error) {
+	return between(n.Pipeline.CreatedAt, n.Pipeline.RunningAt)
+}
+
+// ShortSHA returns the abbreviated commit SHA.
+func (n *Notification) ShortSHA() string {
+	sha := n.Revision.CommitSHA
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+// FailedJobs returns the failed jobs from all blocks.
+func (n *Notification) FailedJobs() []*Job {
+	var jobs []*Job
+	for _, block := range n.Blocks {
+		jobs = append(jobs, block.FailedJobs()...)
+	}
+	return jobs
+}
+
+// WorkflowURL returns the URL of the Semaphore page for the pipeline.
+func (n *Notification) WorkflowURL() string {
+	return fmt.Sprintf("https://%s.semaphoreci.com/workflows/%s?pipeline_id=%s",
+		n.Organization.Name, n.Workflow.Id, n.Pipeline.Id)
+}
+
+// JobURL returns the URL of the Semaphore page for the job with the given id.
+func (n *Notification) JobURL(id string) string {
+	return fmt.Sprintf("https://%s.semaphoreci.com/jobs/%s", n.Organization.Name, id)
+}
+
+// PullRequestURL returns the URL of the GitHub pull request the pipeline ran
+// for, or "" if it wasn't for a pull request.
+func (n *Notification) PullRequestURL() string {
+	if n.Revision.PullRequest == nil || n.Repository.Url == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/pull/%s", n.Repository.Url, n.Revision.PullRequest.Number)
+}
+
+// CompareURL returns the URL of the GitHub page comparing the commits the
+// pipeline ran for with the previous ones, or "" if the range isn't known.
+func (n *Notification) CompareURL() string {
+	commitRange := n.Revision.Branch.CommitRange
+	if commitRange == "" && n.Revision.PullRequest != nil {
+		commitRange = n.Revision.PullRequest.CommitRange
+	}
+	if commitRange == "" || n.Repository.Url == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/compare/%s", n.Repository.Url, commitRange)
+}
+
+// FailedJobs returns the block's failed jobs.
+func (b *Block) FailedJobs() []*Job {
+	var jobs []*Job
+	for _, job := range b.Jobs {
+		if job.Result == ResultFailed {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+func between(start, end string) (time.Duration, error) {
+	startT, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return 0, err
+	}
+	endT, err := time.Parse(time.RFC3339, end)
+	if err != nil {
+		return 0, err
+	}
+	return endT.Sub(startT), nil
 }
@@ -0,0 +1,75 @@
+package semrelay
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/csw/semrelay/internal"
+)
+
+func parseExample(t *testing.T, raw []byte) *Notification {
+	var n Notification
+	require.NoError(t, json.Unmarshal(raw, &n))
+	return &n
+}
+
+func TestNotificationSuccess(t *testing.T) {
+	n := parseExample(t, internal.ExampleSuccess)
+	assert.False(t, n.Failed())
+	assert.False(t, n.IsPromotion())
+	assert.Empty(t, n.FailedJobs())
+	assert.Nil(t, n.Revision.PullRequest)
+	assert.Nil(t, n.Revision.Tag)
+	assert.Equal(t, "78a69d7b-1ad6-4d1d-8fb8-66f929509574", n.Project.Id)
+	assert.Equal(t, "csw", n.Revision.Sender.Login)
+
+	d, err := n.Duration()
+	require.NoError(t, err)
+	assert.Equal(t, 3*time.Minute+52*time.Second, d)
+	q, err := n.QueueTime()
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, q)
+}
+
+func TestNotificationFailure(t *testing.T) {
+	n := parseExample(t, internal.ExampleFailure)
+	assert.True(t, n.Failed())
+	assert.Equal(t, "e97080e", n.ShortSHA())
+	failed := n.FailedJobs()
+	require.Len(t, failed, 1)
+	assert.Equal(t, "Run tests", failed[0].Name)
+	assert.Equal(t,
+		"https://genomenon.semaphoreci.com/jobs/2b1c3afa-efef-44d1-9583-280ccca88840",
+		n.JobURL(failed[0].Id))
+	assert.Equal(t,
+		"https://genomenon.semaphoreci.com/workflows/af05f7b8-fd86-4e9f-87b6-cc5820aa5fea?pipeline_id=d57b4188-9c6f-4dae-9043-ceca7e372970",
+		n.WorkflowURL())
+	assert.Equal(t,
+		"https://github.com/example/otherproject/compare/d2758e435aa592c3b3a23b4173571188c07c74e3...e97080ec66d19282aafae5ddec5f5b51314c4ed8",
+		n.CompareURL())
+	assert.Empty(t, n.PullRequestURL())
+}
+
+func TestNotificationPullRequest(t *testing.T) {
+	raw := []byte(`{
+		"repository": {"url": "https://github.com/example/myproject"},
+		"revision": {
+			"reference_type": "pull_request",
+			"pull_request": {"number": "12", "name": "Fix things", "head_sha": "abc", "commit_range": "a...b"}
+		},
+		"pipeline": {"id": "p2"},
+		"workflow": {"initial_pipeline_id": "p1"}
+	}`)
+	n := parseExample(t, raw)
+	require.NotNil(t, n.Revision.PullRequest)
+	assert.Equal(t, "12", n.Revision.PullRequest.Number)
+	assert.True(t, n.IsPromotion())
+	assert.Equal(t, "https://github.com/example/myproject/pull/12", n.PullRequestURL())
+	assert.Equal(t, "https://github.com/example/myproject/compare/a...b", n.CompareURL())
+	_, err := n.Duration()
+	assert.Error(t, err)
+}
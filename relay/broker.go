@@ -0,0 +1,16 @@
+package relay
+
+// Broker routes notifications, acknowledgements and dismissals to users'
+// clients. A Dispatcher is a Broker for a single relay instance; RedisBroker
+// shares them between instances.
+type Broker interface {
+	// Dispatch sends a notification to the user's clients.
+	Dispatch(user string, payload []byte)
+	// DispatchTest sends a notification marked as a test.
+	DispatchTest(user string, payload []byte)
+	// Ack records that one of the user's clients received a notification.
+	Ack(user *User, id uint64)
+	// Dismiss closes a notification on the user's clients other than the
+	// one that dismissed it.
+	Dismiss(user *User, client Client, id uint64)
+}
@@ -7,5 +7,7 @@ type Client interface {
 
 	TrySend(msg *NotificationTask) bool
 
+	TryDismiss(id uint64) bool
+
 	Disconnect()
 }
@@ -1,6 +1,10 @@
 package relay
 
 import (
+	"context"
+	"math/rand"
+	"sort"
+
 	log "github.com/sirupsen/logrus"
 )
 
@@ -12,12 +16,15 @@ type session struct {
 
 type dispatch struct {
 	user    string
+	id      uint64
 	payload []byte
+	test    bool
 }
 
 type Dispatcher struct {
 	joinCh     chan session
 	dispatchCh chan dispatch
+	usersCh    chan chan<- []*User
 
 	users map[string]*User
 }
@@ -26,6 +33,7 @@ func NewDispatcher() *Dispatcher {
 	return &Dispatcher{
 		joinCh:     make(chan session, 8),
 		dispatchCh: make(chan dispatch, 8),
+		usersCh:    make(chan chan<- []*User),
 		users:      make(map[string]*User),
 	}
 }
@@ -38,7 +46,86 @@ func (d *Dispatcher) Register(user string, client Client) *User {
 }
 
 func (d *Dispatcher) Dispatch(user string, payload []byte) {
-	d.dispatchCh <- dispatch{user: user, payload: payload}
+	d.Deliver(user, rand.Uint64(), payload, false)
+}
+
+func (d *Dispatcher) DispatchTest(user string, payload []byte) {
+	d.Deliver(user, rand.Uint64(), payload, true)
+}
+
+// Deliver dispatches a notification with an id that was already assigned,
+// e.g. by another relay instance.
+func (d *Dispatcher) Deliver(user string, id uint64, payload []byte, test bool) {
+	d.dispatchCh <- dispatch{user: user, id: id, payload: payload, test: test}
+}
+
+// Ack acknowledges receipt of a notification by one of the user's clients.
+func (d *Dispatcher) Ack(user *User, id uint64) {
+	user.Ack(id)
+}
+
+// Dismiss relays a dismissal from one of the user's clients to the others.
+func (d *Dispatcher) Dismiss(user *User, client Client, id uint64) {
+	user.Dismiss(client, id)
+}
+
+// Users returns the users known to the dispatcher, sorted by name. It fails if
+// the dispatcher doesn't respond before the context is done, so it also serves
+// as a liveness check.
+func (d *Dispatcher) Users(ctx context.Context) ([]*User, error) {
+	replyCh := make(chan []*User, 1)
+	select {
+	case d.usersCh <- replyCh:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case users := <-replyCh:
+		return users, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// User returns the user with the given name, or nil if no client has
+// registered for that user.
+func (d *Dispatcher) User(ctx context.Context, name string) (*User, error) {
+	users, err := d.Users(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if user.Name == name {
+			return user, nil
+		}
+	}
+	return nil, nil
+}
+
+// Status returns the status of each known user.
+func (d *Dispatcher) Status(ctx context.Context) ([]UserStatus, error) {
+	users, err := d.Users(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]UserStatus, 0, len(users))
+	for _, user := range users {
+		status, err := user.Status(ctx)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (d *Dispatcher) onUsers(replyCh chan<- []*User) {
+	users := make([]*User, 0, len(d.users))
+	for _, user := range d.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	replyCh <- users
 }
 
 func (d *Dispatcher) onRegister(sess session) {
@@ -54,9 +141,11 @@ func (d *Dispatcher) onRegister(sess session) {
 
 func (d *Dispatcher) onDispatch(msg dispatch) {
 	if user := d.users[msg.user]; user != nil {
-		if err := user.Dispatch(msg.payload); err != nil {
+		if err := user.Deliver(msg.id, msg.payload, msg.test); err != nil {
 			log.Println("Error dispatching message: ", err)
 		}
+	} else {
+		dispatchedTotal.WithLabelValues(resultNoUser).Inc()
 	}
 }
 
@@ -67,6 +156,8 @@ func (d *Dispatcher) Run() {
 			d.onRegister(sess)
 		case msg := <-d.dispatchCh:
 			d.onDispatch(msg)
+		case replyCh := <-d.usersCh:
+			d.onUsers(replyCh)
 		}
 	}
 }
@@ -0,0 +1,57 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/csw/semrelay"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispatcherStatus(t *testing.T) {
+	d := NewDispatcher()
+	go d.Run()
+	c1 := newDummyClient()
+	go d.Register("bob", c1)
+	c1.awaitHello()
+	c2 := newDummyClient()
+	go d.Register("alice", c2)
+	c2.awaitHello()
+	d.Dispatch("alice", []byte("1"))
+	<-c2.msgCh
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	statuses, err := d.Status(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 2)
+	assert.Equal(t, UserStatus{Name: "alice", Clients: []string{"dummy"}, InFlight: 1}, statuses[0])
+	assert.Equal(t, UserStatus{Name: "bob", Clients: []string{"dummy"}}, statuses[1])
+}
+
+func TestDispatcherDispatchTest(t *testing.T) {
+	d := NewDispatcher()
+	go d.Run()
+	c := newDummyClient()
+	go d.Register("alice", c)
+	c.awaitHello()
+	d.Dispatch("alice", []byte("1"))
+	d.DispatchTest("alice", []byte("2"))
+	for _, test := range []bool{false, true} {
+		var msg semrelay.Message
+		require.NoError(t, json.Unmarshal((<-c.msgCh).Payload, &msg))
+		assert.Equal(t, test, msg.Test)
+	}
+}
+
+func TestDispatcherUsersTimeout(t *testing.T) {
+	// not running
+	d := NewDispatcher()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := d.Users(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,52 @@
+package relay
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Delivery results for dispatched notifications.
+const (
+	resultSent   = "sent"
+	resultQueued = "queued"
+	resultNoUser = "no_user"
+)
+
+var (
+	dispatchedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "semrelay_notifications_dispatched_total",
+		Help: "Notifications dispatched to users, by delivery result.",
+	}, []string{"result"})
+
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "semrelay_queue_depth",
+		Help: "Notifications queued for users with no connected clients.",
+	}, []string{"user"})
+
+	inFlightCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "semrelay_in_flight",
+		Help: "Notifications sent to users but not yet acknowledged.",
+	}, []string{"user"})
+
+	connectedClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "semrelay_connected_clients",
+		Help: "Currently connected clients.",
+	})
+
+	ackLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "semrelay_ack_latency_seconds",
+		Help:    "Time from sending a notification to receiving its acknowledgement.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+	})
+
+	slowConsumerDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "semrelay_slow_consumer_disconnects_total",
+		Help: "Clients disconnected because their send queue was full.",
+	})
+)
+
+// updateGauges records the user's current queue lengths.
+func (u *User) updateGauges() {
+	queueDepth.WithLabelValues(u.Name).Set(float64(len(u.queue)))
+	inFlightCount.WithLabelValues(u.Name).Set(float64(len(u.inFlight)))
+}
@@ -0,0 +1,151 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/csw/semrelay"
+)
+
+// publishTimeout bounds publishing an event to Redis.
+const publishTimeout = 5 * time.Second
+
+// RedisBroker shares notifications, acknowledgements and dismissals between
+// relay instances through a Redis pub/sub channel. Each instance handles its
+// own events directly and publishes them for the others, which apply them to
+// their own Dispatcher.
+type RedisBroker struct {
+	d        *Dispatcher
+	client   *redis.Client
+	channel  string
+	instance string
+}
+
+// brokerEvent is published to the channel for each notification,
+// acknowledgement and dismissal. Type is a semrelay message type.
+type brokerEvent struct {
+	Instance string          `json:"instance"`
+	Type     string          `json:"type"`
+	User     string          `json:"user"`
+	Id       uint64          `json:"id,string"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Test     bool            `json:"test,omitempty"`
+}
+
+func NewRedisBroker(d *Dispatcher, client *redis.Client, channel string) *RedisBroker {
+	return &RedisBroker{
+		d:        d,
+		client:   client,
+		channel:  channel,
+		instance: strconv.FormatUint(rand.Uint64(), 36),
+	}
+}
+
+func (b *RedisBroker) Dispatch(user string, payload []byte) {
+	b.dispatch(user, payload, false)
+}
+
+func (b *RedisBroker) DispatchTest(user string, payload []byte) {
+	b.dispatch(user, payload, true)
+}
+
+func (b *RedisBroker) dispatch(user string, payload []byte, test bool) {
+	id := rand.Uint64()
+	b.d.Deliver(user, id, payload, test)
+	b.publish(brokerEvent{Type: semrelay.NotificationMsg, User: user, Id: id,
+		Payload: payload, Test: test})
+}
+
+func (b *RedisBroker) Ack(user *User, id uint64) {
+	user.Ack(id)
+	b.publish(brokerEvent{Type: semrelay.AckMsg, User: user.Name, Id: id})
+}
+
+func (b *RedisBroker) Dismiss(user *User, client Client, id uint64) {
+	user.Dismiss(client, id)
+	b.publish(brokerEvent{Type: semrelay.DismissMsg, User: user.Name, Id: id})
+}
+
+// Ping checks that Redis is reachable.
+func (b *RedisBroker) Ping(ctx context.Context) error {
+	return b.client.Ping(ctx).Err()
+}
+
+func (b *RedisBroker) publish(ev brokerEvent) {
+	ev.Instance = b.instance
+	enc, err := json.Marshal(&ev)
+	if err != nil {
+		panic(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	if err := b.client.Publish(ctx, b.channel, enc).Err(); err != nil {
+		log.WithError(err).WithField("type", ev.Type).Error("Failed to publish to Redis")
+	}
+}
+
+// Run subscribes to the channel and applies events from other instances
+// until the context is done. Once subscribed, the Redis client resubscribes
+// automatically if the connection is lost.
+func (b *RedisBroker) Run(ctx context.Context) error {
+	sub := b.client.Subscribe(ctx, b.channel)
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		return fmt.Errorf("subscribing to %s: %w", b.channel, err)
+	}
+	log.WithField("channel", b.channel).Info("Subscribed to Redis")
+	ch := sub.Channel()
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			b.onMessage(ctx, msg.Payload)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (b *RedisBroker) onMessage(ctx context.Context, payload string) {
+	var ev brokerEvent
+	if err := json.Unmarshal([]byte(payload), &ev); err != nil {
+		log.WithError(err).Error("Malformed event from Redis")
+		return
+	}
+	if ev.Instance == b.instance {
+		return
+	}
+	elog := log.WithFields(log.Fields{"user": ev.User, "id": ev.Id, "from": ev.Instance})
+	if ev.Type == semrelay.NotificationMsg {
+		elog.Debug("Received notification from another instance")
+		b.d.Deliver(ev.User, ev.Id, ev.Payload, ev.Test)
+		return
+	}
+	user, err := b.d.User(ctx, ev.User)
+	if err != nil || user == nil {
+		// not connected to this instance, so nothing to update
+		return
+	}
+	switch ev.Type {
+	case semrelay.AckMsg:
+		elog.Debug("Received ack from another instance")
+		err = user.AckRemote(ctx, ev.Id)
+	case semrelay.DismissMsg:
+		elog.Debug("Received dismissal from another instance")
+		err = user.DismissRemote(ctx, ev.Id)
+	default:
+		elog.WithField("type", ev.Type).Error("Unexpected event from Redis")
+	}
+	if err != nil && ctx.Err() == nil {
+		elog.WithError(err).Error("Error applying event from another instance")
+	}
+}
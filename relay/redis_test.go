@@ -0,0 +1,155 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+const testChannel = "semrelay-test"
+
+func startRedisBroker(t *testing.T, mr *miniredis.Miniredis) (*Dispatcher, *RedisBroker) {
+	d := NewDispatcher()
+	go d.Run()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	b := NewRedisBroker(d, client, testChannel)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	subscribers := mr.PubSubNumSub(testChannel)[testChannel]
+	go b.Run(ctx)
+	require.Eventually(t, func() bool {
+		return mr.PubSubNumSub(testChannel)[testChannel] > subscribers
+	}, time.Second, 10*time.Millisecond)
+	return d, b
+}
+
+func registerDummy(d *Dispatcher, user string) (*User, *dummyClient) {
+	client := newDummyClient()
+	userCh := make(chan *User, 1)
+	go func() { userCh <- d.Register(user, client) }()
+	client.awaitHello()
+	return <-userCh, client
+}
+
+func TestRedisBrokerDispatch(t *testing.T) {
+	mr := miniredis.RunT(t)
+	d1, b1 := startRedisBroker(t, mr)
+	d2, _ := startRedisBroker(t, mr)
+	_, c1 := registerDummy(d1, "alice")
+	_, c2 := registerDummy(d2, "alice")
+
+	b1.Dispatch("alice", []byte("1"))
+	msg1 := <-c1.msgCh
+	msg2 := <-c2.msgCh
+	require.Equal(t, msg1.Id, msg2.Id)
+	require.Equal(t, msg1.Payload, msg2.Payload)
+}
+
+func TestRedisBrokerAck(t *testing.T) {
+	mr := miniredis.RunT(t)
+	d1, b1 := startRedisBroker(t, mr)
+	d2, b2 := startRedisBroker(t, mr)
+	u1, c1 := registerDummy(d1, "alice")
+	u2, c2 := registerDummy(d2, "alice")
+
+	b1.Dispatch("alice", []byte("1"))
+	msg := <-c1.msgCh
+	<-c2.msgCh
+	b2.Ack(u2, msg.Id)
+	require.Eventually(t, func() bool {
+		status, err := u1.Status(context.Background())
+		return err == nil && status.InFlight == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRedisBrokerDismiss(t *testing.T) {
+	mr := miniredis.RunT(t)
+	d1, b1 := startRedisBroker(t, mr)
+	d2, _ := startRedisBroker(t, mr)
+	u1, c1 := registerDummy(d1, "alice")
+	u2, c2 := registerDummy(d2, "alice")
+
+	b1.Dispatch("alice", []byte("1"))
+	msg := <-c1.msgCh
+	<-c2.msgCh
+	b1.Dismiss(u1, c1, msg.Id)
+	select {
+	case id := <-c2.dismissCh:
+		require.Equal(t, msg.Id, id)
+	case <-time.After(time.Second):
+		t.Fatal("dismissal not relayed")
+	}
+	require.Empty(t, c1.dismissCh)
+	status, err := u2.Status(context.Background())
+	require.NoError(t, err)
+	require.Zero(t, status.InFlight)
+}
+
+func TestRedisBrokerRemoteAckRemovesQueued(t *testing.T) {
+	mr := miniredis.RunT(t)
+	d1, _ := startRedisBroker(t, mr)
+	d2, b2 := startRedisBroker(t, mr)
+	// alice has connected to the first instance, but isn't any more
+	u1, c1 := registerDummy(d1, "alice")
+	u1.Leave(c1)
+	u2, c2 := registerDummy(d2, "alice")
+
+	b2.Dispatch("alice", []byte("1"))
+	msg := <-c2.msgCh
+	require.Eventually(t, func() bool {
+		status, err := u1.Status(context.Background())
+		return err == nil && status.Queued == 1
+	}, time.Second, 10*time.Millisecond)
+	b2.Ack(u2, msg.Id)
+	require.Eventually(t, func() bool {
+		status, err := u1.Status(context.Background())
+		return err == nil && status.Queued == 0
+	}, time.Second, 10*time.Millisecond)
+
+	_, c3 := registerDummy(d1, "alice")
+	select {
+	case msg := <-c3.msgCh:
+		t.Fatalf("acknowledged notification %d redelivered", msg.Id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRedisBrokerRemoteDismissRemovesQueued(t *testing.T) {
+	mr := miniredis.RunT(t)
+	d1, _ := startRedisBroker(t, mr)
+	d2, b2 := startRedisBroker(t, mr)
+	u1, c1 := registerDummy(d1, "alice")
+	u1.Leave(c1)
+	u2, c2 := registerDummy(d2, "alice")
+
+	b2.Dispatch("alice", []byte("1"))
+	msg := <-c2.msgCh
+	require.Eventually(t, func() bool {
+		status, err := u1.Status(context.Background())
+		return err == nil && status.Queued == 1
+	}, time.Second, 10*time.Millisecond)
+	b2.Dismiss(u2, c2, msg.Id)
+	require.Eventually(t, func() bool {
+		status, err := u1.Status(context.Background())
+		return err == nil && status.Queued == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestUserRemoteAckBeforeDispatch(t *testing.T) {
+	user := NewUser("bob")
+	go user.Run()
+	require.NoError(t, user.AckRemote(context.Background(), 42))
+	require.NoError(t, user.Deliver(42, json.RawMessage("1"), false))
+	require.NoError(t, user.Deliver(43, json.RawMessage("2"), false))
+	c1 := newDummyClient()
+	syncJoin(user, c1)
+	msg := <-c1.msgCh
+	require.Equal(t, uint64(43), msg.Id)
+	require.Empty(t, c1.msgCh)
+}
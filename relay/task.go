@@ -1,6 +1,7 @@
 package relay
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -19,3 +20,33 @@ func NewNotificationTask(id uint64, user string, payload []byte) *NotificationTa
 		Payload: payload,
 	}
 }
+
+// markSent records when the notification was first sent, to measure
+// acknowledgement latency.
+func (nt *NotificationTask) markSent() {
+	if nt.Sent == nil {
+		now := time.Now()
+		nt.Sent = &now
+	}
+}
+
+// TaskInfo describes a pending notification for administrative purposes.
+type TaskInfo struct {
+	Id      uint64          `json:"id,string"`
+	Sent    *time.Time      `json:"sent,omitempty"`
+	Message json.RawMessage `json:"message"`
+}
+
+// QueueDump lists a user's pending notifications.
+type QueueDump struct {
+	Queued   []TaskInfo `json:"queued"`
+	InFlight []TaskInfo `json:"in_flight"`
+}
+
+func taskInfos(tasks []*NotificationTask) []TaskInfo {
+	infos := make([]TaskInfo, 0, len(tasks))
+	for _, task := range tasks {
+		infos = append(infos, TaskInfo{Id: task.Id, Sent: task.Sent, Message: task.Payload})
+	}
+	return infos
+}
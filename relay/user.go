@@ -1,8 +1,10 @@
 package relay
 
 import (
+	"context"
 	"encoding/json"
 	"math/rand"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -10,33 +12,63 @@ import (
 )
 
 type User struct {
-	Name     string
-	msgCh    chan *NotificationTask
-	ackCh    chan uint64
-	joinCh   chan Client
-	leaveCh  chan Client
-	queue    []*NotificationTask
-	inFlight []*NotificationTask
-	clients  []Client
+	Name      string
+	msgCh     chan *NotificationTask
+	ackCh     chan uint64
+	dismissCh chan dismissal
+	joinCh    chan Client
+	leaveCh   chan Client
+	opCh      chan func()
+	queue     []*NotificationTask
+	inFlight  []*NotificationTask
+	clients   []Client
+	// remoteAcks are the ids most recently acknowledged or dismissed through
+	// other relay instances, in case the acknowledgement arrives before the
+	// notification itself.
+	remoteAcks []uint64
+}
+
+// dismissal records that a client closed the notification with the given
+// id, so the user's other clients can close it too.
+type dismissal struct {
+	id     uint64
+	client Client
+}
+
+// UserStatus describes a user's connected clients and pending notifications.
+type UserStatus struct {
+	Name     string   `json:"name"`
+	Clients  []string `json:"clients"`
+	Queued   int      `json:"queued"`
+	InFlight int      `json:"in_flight"`
 }
 
 const (
-	queueMax = 8
+	queueMax      = 8
+	remoteAcksMax = 4 * queueMax
 )
 
 func NewUser(name string) *User {
 	return &User{
-		Name:    name,
-		msgCh:   make(chan *NotificationTask, queueMax),
-		ackCh:   make(chan uint64, 1),
-		joinCh:  make(chan Client, 1),
-		leaveCh: make(chan Client, 1),
+		Name:      name,
+		msgCh:     make(chan *NotificationTask, queueMax),
+		ackCh:     make(chan uint64, 1),
+		dismissCh: make(chan dismissal, 1),
+		joinCh:    make(chan Client, 1),
+		leaveCh:   make(chan Client, 1),
+		opCh:      make(chan func()),
 	}
 }
 
 func (u *User) Dispatch(payload json.RawMessage) error {
-	id := rand.Uint64()
+	return u.Deliver(rand.Uint64(), payload, false)
+}
+
+// Deliver dispatches a notification with an id that was already assigned,
+// optionally marked as a test.
+func (u *User) Deliver(id uint64, payload json.RawMessage, test bool) error {
 	msg := semrelay.MakeNotification(id, payload)
+	msg.Test = test
 	enc, err := json.Marshal(&msg)
 	if err != nil {
 		return err
@@ -49,6 +81,12 @@ func (u *User) Ack(id uint64) {
 	u.ackCh <- id
 }
 
+// Dismiss relays a dismissal of the notification with the given id from one
+// client to the user's other connected clients.
+func (u *User) Dismiss(client Client, id uint64) {
+	u.dismissCh <- dismissal{id: id, client: client}
+}
+
 func (u *User) Join(client Client) {
 	u.joinCh <- client
 }
@@ -57,6 +95,78 @@ func (u *User) Leave(client Client) {
 	u.leaveCh <- client
 }
 
+// do runs f in the user's goroutine, so that it can safely inspect and modify
+// the user's state, and waits for it to complete.
+func (u *User) do(ctx context.Context, f func()) error {
+	done := make(chan struct{})
+	select {
+	case u.opCh <- func() { f(); close(done) }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status queries the user's goroutine for its current status.
+func (u *User) Status(ctx context.Context) (UserStatus, error) {
+	var status UserStatus
+	err := u.do(ctx, func() { status = u.status() })
+	return status, err
+}
+
+// Queue returns the user's queued and in-flight notifications.
+func (u *User) Queue(ctx context.Context) (QueueDump, error) {
+	var dump QueueDump
+	err := u.do(ctx, func() {
+		dump.Queued = taskInfos(u.queue)
+		dump.InFlight = taskInfos(u.inFlight)
+	})
+	return dump, err
+}
+
+// Purge discards the queued or in-flight notification with the given id,
+// reporting whether it was found.
+func (u *User) Purge(ctx context.Context, id uint64) (bool, error) {
+	var found bool
+	err := u.do(ctx, func() { found = u.remove(id) != nil })
+	return found, err
+}
+
+// Requeue resends the queued or in-flight notification with the given id to
+// the user's connected clients, or queues it if none are connected. It reports
+// whether the notification was found.
+func (u *User) Requeue(ctx context.Context, id uint64) (bool, error) {
+	var found bool
+	err := u.do(ctx, func() {
+		if task := u.remove(id); task != nil {
+			found = true
+			u.onDispatch(task)
+		}
+	})
+	return found, err
+}
+
+// Kick disconnects the user's client with the given address, reporting
+// whether it was connected.
+func (u *User) Kick(ctx context.Context, client string) (bool, error) {
+	var found bool
+	err := u.do(ctx, func() {
+		for _, existing := range u.clients {
+			if existing.String() == client {
+				found = true
+				u.deregister(existing)
+				return
+			}
+		}
+	})
+	return found, err
+}
+
 func (u *User) Run() {
 	for {
 		select {
@@ -64,44 +174,146 @@ func (u *User) Run() {
 			u.onDispatch(msg)
 		case id := <-u.ackCh:
 			u.onAck(id)
+		case d := <-u.dismissCh:
+			u.onDismiss(d)
 		case client := <-u.joinCh:
 			u.register(client)
 		case client := <-u.leaveCh:
 			u.deregister(client)
+		case op := <-u.opCh:
+			op()
 		}
 	}
 }
 
+func (u *User) status() UserStatus {
+	clients := make([]string, 0, len(u.clients))
+	for _, client := range u.clients {
+		clients = append(clients, client.String())
+	}
+	return UserStatus{
+		Name:     u.Name,
+		Clients:  clients,
+		Queued:   len(u.queue),
+		InFlight: len(u.inFlight),
+	}
+}
+
 func (u *User) onDispatch(msg *NotificationTask) {
+	if u.ackedRemotely(msg.Id) {
+		log.WithFields(log.Fields{"user": u.Name, "id": msg.Id}).
+			Debug("Dropping notification already acknowledged elsewhere")
+		return
+	}
 	if len(u.clients) > 0 {
 		// send to each active client
 		sent := false
 		for _, client := range u.clients {
 			if !client.TrySend(msg) {
-				log.Println("Failed to send message to", client)
+				u.slowConsumer(client, "message")
 				u.deregister(client)
 				break
 			}
 			sent = true
 		}
 		if sent {
+			msg.markSent()
 			u.inFlight = appendBounded(u.inFlight, msg)
+			dispatchedTotal.WithLabelValues(resultSent).Inc()
 		} else {
 			u.queue = appendBounded(u.queue, msg)
+			dispatchedTotal.WithLabelValues(resultQueued).Inc()
 		}
 	} else {
 		// no clients connected, queue up the message
 		u.queue = appendBounded(u.queue, msg)
+		dispatchedTotal.WithLabelValues(resultQueued).Inc()
 	}
+	u.updateGauges()
+}
+
+// remove removes the notification with the given id from the queue or the
+// in-flight list, returning it if found.
+func (u *User) remove(id uint64) *NotificationTask {
+	var task *NotificationTask
+	u.queue, task = removeTask(u.queue, id)
+	if task == nil {
+		u.inFlight, task = removeTask(u.inFlight, id)
+	}
+	if task != nil {
+		u.updateGauges()
+	}
+	return task
 }
 
 func (u *User) onAck(id uint64) {
-	for i, task := range u.inFlight {
-		if task.Id == id {
-			// copy rest of slice forward, truncate
-			copy(u.inFlight[i:], u.inFlight[i+1:])
-			u.inFlight = u.inFlight[:len(u.inFlight)-1]
-			return
+	var task *NotificationTask
+	u.inFlight, task = removeTask(u.inFlight, id)
+	if task == nil {
+		return
+	}
+	if task.Sent != nil {
+		ackLatency.Observe(time.Since(*task.Sent).Seconds())
+	}
+	u.updateGauges()
+}
+
+// AckRemote records that the notification with the given id was acknowledged
+// through another relay instance. It's removed whether it was queued or in
+// flight here, so it isn't delivered again when a client connects.
+func (u *User) AckRemote(ctx context.Context, id uint64) error {
+	return u.do(ctx, func() { u.onRemoteAck(id) })
+}
+
+// DismissRemote relays a dismissal received through another relay instance
+// to the user's clients here, and removes the notification like AckRemote.
+func (u *User) DismissRemote(ctx context.Context, id uint64) error {
+	return u.do(ctx, func() {
+		u.onRemoteAck(id)
+		u.relayDismissal(dismissal{id: id})
+	})
+}
+
+func (u *User) onRemoteAck(id uint64) {
+	if u.remove(id) != nil {
+		return
+	}
+	if len(u.remoteAcks) >= remoteAcksMax {
+		u.remoteAcks = u.remoteAcks[1:]
+	}
+	u.remoteAcks = append(u.remoteAcks, id)
+}
+
+// ackedRemotely reports whether the notification was already acknowledged
+// through another instance, forgetting it if so.
+func (u *User) ackedRemotely(id uint64) bool {
+	for i, acked := range u.remoteAcks {
+		if acked == id {
+			u.remoteAcks = append(u.remoteAcks[:i], u.remoteAcks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) onDismiss(d dismissal) {
+	// A dismissed notification has been seen, so there's no need to redeliver
+	// it.
+	u.onAck(d.id)
+	u.relayDismissal(d)
+}
+
+// relayDismissal tells the user's clients other than the one that dismissed
+// the notification to close it.
+func (u *User) relayDismissal(d dismissal) {
+	for _, client := range u.clients {
+		if client == d.client {
+			continue
+		}
+		if !client.TryDismiss(d.id) {
+			u.slowConsumer(client, "dismissal")
+			u.deregister(client)
+			break
 		}
 	}
 }
@@ -112,37 +324,77 @@ func (u *User) register(client Client) {
 		// send pending messages
 		for _, msg := range u.inFlight {
 			if !client.TrySend(msg) {
-				log.Println("Failed to send pending in-flight messages to ", client)
+				u.slowConsumer(client, "pending in-flight messages")
 				client.Disconnect()
 				return
 			}
 		}
 		for _, msg := range u.queue {
 			if !client.TrySend(msg) {
-				log.Println("Failed to send pending queued messages to ", client)
+				u.slowConsumer(client, "pending queued messages")
 				client.Disconnect()
 				return
 			}
 		}
+		for _, msg := range u.queue {
+			msg.markSent()
+		}
 		u.inFlight = append(u.inFlight, u.queue...)
 		u.queue = u.queue[:0]
+		u.updateGauges()
 	}
 	u.clients = append(u.clients, client)
+	connectedClients.Inc()
 	log.WithField("client", client).WithField("user", u.Name).Info("Registered")
 }
 
+// SlowConsumerHook, if set, is called when a client is disconnected because
+// it isn't keeping up with what's sent to it. It's called from the user's
+// goroutine, so it must not block.
+var SlowConsumerHook func(user string, client Client)
+
+// slowConsumer records that what couldn't be sent to the client, before it's
+// disconnected.
+func (u *User) slowConsumer(client Client, what string) {
+	log.WithFields(log.Fields{"client": client, "user": u.Name}).
+		Warnf("Failed to send %s, disconnecting", what)
+	slowConsumerDisconnects.Inc()
+	if SlowConsumerHook != nil {
+		SlowConsumerHook(u.Name, client)
+	}
+}
+
 func (u *User) deregister(client Client) {
 	var nClients []Client
+	found := false
 	for _, existing := range u.clients {
 		if existing != client {
 			nClients = append(nClients, existing)
+		} else {
+			found = true
 		}
 	}
+	if !found {
+		// already deregistered, e.g. after a failed send
+		return
+	}
 	u.clients = nClients
+	connectedClients.Dec()
 	client.Disconnect()
 	log.WithField("client", client).WithField("user", u.Name).Debug("Deregistered")
 }
 
+func removeTask(q []*NotificationTask, id uint64) ([]*NotificationTask, *NotificationTask) {
+	for i, task := range q {
+		if task.Id == id {
+			// copy rest of slice forward, truncate
+			copy(q[i:], q[i+1:])
+			return q[:len(q)-1], task
+		}
+	}
+	return q, nil
+}
+
 func appendBounded(q []*NotificationTask, nt *NotificationTask) []*NotificationTask {
 	if len(q) < queueMax {
 		return append(q, nt)
@@ -1,12 +1,15 @@
 package relay
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/csw/semrelay"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -15,7 +18,10 @@ type dummyClient struct {
 	ok        bool
 	helloCh   chan struct{}
 	msgCh     chan *NotificationTask
-	connected bool
+	dismissCh chan uint64
+	// connected is set by Disconnect on the user's goroutine, so it's
+	// accessed atomically.
+	connected int32
 }
 
 func newDummyClient() *dummyClient {
@@ -23,7 +29,8 @@ func newDummyClient() *dummyClient {
 		ok:        true,
 		helloCh:   make(chan struct{}),
 		msgCh:     make(chan *NotificationTask, 32),
-		connected: true,
+		dismissCh: make(chan uint64, 32),
+		connected: 1,
 	}
 }
 
@@ -52,8 +59,31 @@ func (dc *dummyClient) TrySend(msg *NotificationTask) bool {
 	}
 }
 
+func (dc *dummyClient) TryDismiss(id uint64) bool {
+	if dc.ok {
+		select {
+		case dc.dismissCh <- id:
+			return true
+		default:
+			return false
+		}
+	} else {
+		return false
+	}
+}
+
 func (dc *dummyClient) Disconnect() {
-	dc.connected = false
+	atomic.StoreInt32(&dc.connected, 0)
+}
+
+func (dc *dummyClient) isConnected() bool {
+	return atomic.LoadInt32(&dc.connected) == 1
+}
+
+// assertDisconnected waits for the client to be disconnected.
+func assertDisconnected(t *testing.T, dc *dummyClient) {
+	t.Helper()
+	assert.Eventually(t, func() bool { return !dc.isConnected() }, time.Second, 5*time.Millisecond)
 }
 
 func TestUserQueue(t *testing.T) {
@@ -89,8 +119,7 @@ func TestUserErrorToQueue(t *testing.T) {
 	syncJoin(user, c1)
 	c1.ok = false
 	require.NoError(t, user.Dispatch(json.RawMessage("1")))
-	time.Sleep(20 * time.Millisecond)
-	assert.False(t, c1.connected)
+	assertDisconnected(t, c1)
 	c2 := newDummyClient()
 	syncJoin(user, c2)
 	r1 := <-c2.msgCh
@@ -106,8 +135,7 @@ func TestUserErrorFromQueue(t *testing.T) {
 	c1 := newDummyClient()
 	c1.ok = false
 	syncJoin(user, c1)
-	time.Sleep(20 * time.Millisecond)
-	assert.False(t, c1.connected)
+	assertDisconnected(t, c1)
 	c2 := newDummyClient()
 	syncJoin(user, c2)
 	r1 := <-c2.msgCh
@@ -157,8 +185,7 @@ func TestUserRedeliveryFailure(t *testing.T) {
 	c2 := newDummyClient()
 	c2.ok = false
 	syncJoin(user, c2)
-	time.Sleep(100 * time.Millisecond)
-	assert.False(t, c2.connected)
+	assertDisconnected(t, c2)
 }
 
 func TestUserAck(t *testing.T) {
@@ -181,6 +208,136 @@ func TestUserAck(t *testing.T) {
 	}
 }
 
+func TestUserDismiss(t *testing.T) {
+	user := NewUser("bob")
+	go user.Run()
+	c1 := newDummyClient()
+	syncJoin(user, c1)
+	c2 := newDummyClient()
+	syncJoin(user, c2)
+	require.NoError(t, user.Dispatch(json.RawMessage("1")))
+	nt1 := <-c1.msgCh
+	<-c2.msgCh
+	user.Dismiss(c1, nt1.Id)
+	assert.Equal(t, nt1.Id, <-c2.dismissCh)
+	select {
+	case <-c1.dismissCh:
+		t.Fatal("dismissal sent back to originating client")
+	default:
+	}
+}
+
+func TestUserDismissNoRedelivery(t *testing.T) {
+	user := NewUser("bob")
+	go user.Run()
+	c1 := newDummyClient()
+	syncJoin(user, c1)
+	require.NoError(t, user.Dispatch(json.RawMessage("1")))
+	nt1 := <-c1.msgCh
+	user.Dismiss(c1, nt1.Id)
+	user.Leave(c1)
+	c2 := newDummyClient()
+	syncJoin(user, c2)
+	timeout := time.NewTimer(100 * time.Millisecond)
+	select {
+	case <-c2.msgCh:
+		t.Fatal("saw redelivery")
+	case <-timeout.C:
+		// OK
+	}
+}
+
+func TestUserQueueMetrics(t *testing.T) {
+	user := NewUser("carol")
+	go user.Run()
+	require.NoError(t, user.Dispatch(json.RawMessage("1")))
+	require.NoError(t, user.Dispatch(json.RawMessage("2")))
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 2.0, testutil.ToFloat64(queueDepth.WithLabelValues("carol")))
+	c1 := newDummyClient()
+	syncJoin(user, c1)
+	nt1 := <-c1.msgCh
+	<-c1.msgCh
+	user.Ack(nt1.Id)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0.0, testutil.ToFloat64(queueDepth.WithLabelValues("carol")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(inFlightCount.WithLabelValues("carol")))
+}
+
+func TestUserQueueDump(t *testing.T) {
+	user := NewUser("bob")
+	go user.Run()
+	c1 := newDummyClient()
+	syncJoin(user, c1)
+	require.NoError(t, user.Dispatch(json.RawMessage("1")))
+	nt1 := <-c1.msgCh
+	user.Leave(c1)
+	require.NoError(t, user.Dispatch(json.RawMessage("2")))
+	time.Sleep(20 * time.Millisecond)
+	dump, err := user.Queue(context.Background())
+	require.NoError(t, err)
+	require.Len(t, dump.InFlight, 1)
+	require.Len(t, dump.Queued, 1)
+	assert.Equal(t, nt1.Id, dump.InFlight[0].Id)
+	assert.NotNil(t, dump.InFlight[0].Sent)
+}
+
+func TestUserPurge(t *testing.T) {
+	user := NewUser("bob")
+	go user.Run()
+	c1 := newDummyClient()
+	syncJoin(user, c1)
+	require.NoError(t, user.Dispatch(json.RawMessage("1")))
+	nt1 := <-c1.msgCh
+	found, err := user.Purge(context.Background(), nt1.Id)
+	require.NoError(t, err)
+	assert.True(t, found)
+	found, err = user.Purge(context.Background(), nt1.Id)
+	require.NoError(t, err)
+	assert.False(t, found)
+	user.Leave(c1)
+	c2 := newDummyClient()
+	syncJoin(user, c2)
+	timeout := time.NewTimer(100 * time.Millisecond)
+	select {
+	case <-c2.msgCh:
+		t.Fatal("saw redelivery")
+	case <-timeout.C:
+		// OK
+	}
+}
+
+func TestUserRequeue(t *testing.T) {
+	user := NewUser("bob")
+	go user.Run()
+	c1 := newDummyClient()
+	syncJoin(user, c1)
+	require.NoError(t, user.Dispatch(json.RawMessage("1")))
+	nt1 := <-c1.msgCh
+	found, err := user.Requeue(context.Background(), nt1.Id)
+	require.NoError(t, err)
+	assert.True(t, found)
+	nt2 := <-c1.msgCh
+	assert.Equal(t, nt1.Id, nt2.Id)
+}
+
+func TestUserKick(t *testing.T) {
+	user := NewUser("bob")
+	go user.Run()
+	c1 := newDummyClient()
+	syncJoin(user, c1)
+	found, err := user.Kick(context.Background(), "nobody")
+	require.NoError(t, err)
+	assert.False(t, found)
+	found, err = user.Kick(context.Background(), c1.String())
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.False(t, c1.isConnected())
+	status, err := user.Status(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, status.Clients)
+}
+
 func TestDropSlowUser(t *testing.T) {
 	user := NewUser("bob")
 	go user.Run()
@@ -188,8 +345,30 @@ func TestDropSlowUser(t *testing.T) {
 	c1.ok = false
 	syncJoin(user, c1)
 	require.NoError(t, user.Dispatch(json.RawMessage("1")))
-	time.Sleep(20 * time.Millisecond)
-	assert.False(t, c1.connected)
+	assertDisconnected(t, c1)
+}
+
+func TestSlowConsumerHook(t *testing.T) {
+	type slow struct {
+		user   string
+		client Client
+	}
+	slowCh := make(chan slow, 1)
+	SlowConsumerHook = func(user string, client Client) { slowCh <- slow{user, client} }
+	defer func() { SlowConsumerHook = nil }()
+	user := NewUser("bob")
+	go user.Run()
+	c1 := newDummyClient()
+	c1.ok = false
+	syncJoin(user, c1)
+	require.NoError(t, user.Dispatch(json.RawMessage("1")))
+	select {
+	case s := <-slowCh:
+		assert.Equal(t, "bob", s.user)
+		assert.Same(t, c1, s.client)
+	case <-time.After(time.Second):
+		t.Fatal("slow consumer not reported")
+	}
 }
 
 func TestUserDispatchGarbage(t *testing.T) {